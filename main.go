@@ -6,13 +6,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/celzero/gateway/midway"
 	"github.com/celzero/gateway/midway/env"
+	"github.com/celzero/gateway/midway/relay"
 	proxyproto "github.com/pires/go-proxyproto"
 )
 
@@ -22,95 +26,137 @@ func main() {
 		"h11":    ":80",
 		"tls":    ":443",
 		"dot":    ":853",
+		"doq":    ":853",
 		"flydoh": ":1443",
 		"flydot": ":1853",
+		"hproxy": ":3128",
+		"socks5": ":1080",
 		"echo":   ":5000",
 		"ppecho": ":5001",
+		"status": ":8091",
 	}
 	if !env.Sudo() {
 		portmap["tls"] = ":8443"
 		portmap["dot"] = ":8853"
+		portmap["doq"] = ":8853"
 		portmap["h11"] = ":8080"
 	}
 
-	totallisteners := len(portmap)
-	hold := barrier(totallisteners)
+	up, err := midway.NewUpstreams(env.UpstreamDoh(), env.UpstreamStrategy(), env.UpstreamHedgeDelay())
+	if err != nil {
+		log.Fatal("upstreams: ", err)
+	}
+	resolver := midway.NewDohStub(up, midway.Middlewares()...)
+	if env.RelayResolver() == "doh" {
+		relay.UseResolver(resolver)
+	}
 
+	// critical listeners, if they can't be recovered, take the process
+	// down with them; proxyproto listener works with plain tcp, too
 	// cleartext http1.x on port 80
-	t80, err := net.Listen("tcp", portmap["h11"])
-	ko(err)
-	fmt.Println("started: pptcp-server on port ", portmap["h11"])
-	pp80 := &proxyproto.Listener{Listener: t80}
-
+	midway.Supervise("h11", true, pp(portmap["h11"], midway.StartPPL7))
 	// tcp-tls (http2 / http1.1) on port 443
-	t443, err := net.Listen("tcp", portmap["tls"])
-	ko(err)
-	fmt.Println("started: pptcp-server on port ", portmap["tls"])
-	pp443 := &proxyproto.Listener{Listener: t443}
-
+	midway.Supervise("tls", true, pp(portmap["tls"], func(l *proxyproto.Listener) error {
+		return midway.StartPPWithDoH(l, resolver)
+	}))
 	// tcp-tls (DNS over TLS) on port 853
-	t853, err := net.Listen("tcp", portmap["dot"])
-	ko(err)
-	fmt.Println("started: pptcp-server on port ", portmap["dot"])
-	pp853 := &proxyproto.Listener{Listener: t853}
-
+	midway.Supervise("dot", true, pp(portmap["dot"], func(l *proxyproto.Listener) error {
+		return midway.StartPPWithDoT(l, resolver)
+	}))
+	// quic (DNS over QUIC) on udp port 853
+	midway.Supervise("doq", false, func() error {
+		// ref: fly.io/docs/app-guides/udp-and-tcp/
+		u853, err := net.ListenPacket("udp", "fly-global-services"+portmap["doq"])
+		if err != nil {
+			log.Println(err)
+			if u853, err = net.ListenPacket("udp", portmap["doq"]); err != nil {
+				return err
+			}
+		}
+		fmt.Println("started: doq-server on port ", portmap["doq"])
+		return midway.StartDoQ(u853, resolver)
+	})
 	// fly terminated tls (http2 and http1.1) on port 1443
-	t1443, err := net.Listen("tcp", portmap["flydoh"])
-	ko(err)
-	fmt.Println("started: pptcp-server on port ", portmap["flydoh"])
-	pp1443 := &proxyproto.Listener{Listener: t1443}
-
+	midway.Supervise("flydoh", true, pp(portmap["flydoh"], func(l *proxyproto.Listener) error {
+		return midway.StartPPWithDoHCleartext(l, resolver)
+	}))
 	// fly terminated tls (DNS over TLS) on port 1853
-	t1853, err := net.Listen("tcp", portmap["flydot"])
-	ko(err)
-	fmt.Println("started: pptcp-server on port ", portmap["flydot"])
-	pp1853 := &proxyproto.Listener{Listener: t1853}
-
-	// ref: fly.io/docs/app-guides/udp-and-tcp/
-	u5000, err := net.ListenPacket("udp", "fly-global-services:5000")
-	if err != nil {
-		log.Println(err)
-		if pc5000, err := net.ListenPacket("udp", portmap["echo"]); err != nil {
-			ko(err)
-		} else {
-			u5000 = pc5000
-		}
+	midway.Supervise("flydot", true, pp(portmap["flydot"], func(l *proxyproto.Listener) error {
+		return midway.StartPPWithDoTCleartext(l, resolver)
+	}))
+	// explicit http proxy (CONNECT and absolute-form) on port 3128, and
+	// socks5 proxy on port 1080; only for authenticated clients
+	if relay.HasProxyUsers() {
+		midway.Supervise("hproxy", false, pp(portmap["hproxy"], midway.StartHttpProxy))
+		midway.Supervise("socks5", false, pp(portmap["socks5"], midway.StartSocks))
+	} else {
+		log.Print("main: no SOCKS_USERS; http and socks5 proxies off")
 	}
-	fmt.Println("started: udp-server on port ", portmap["echo"])
-
-	t5000, err := net.Listen("tcp", portmap["echo"])
-	ko(err)
-	fmt.Println("started: tcp-server on port ", portmap["echo"])
-
-	t5001, err := net.Listen("tcp", portmap["ppecho"])
-	ko(err)
-	fmt.Println("started: pptcp-server on port ", portmap["ppecho"])
-	pp5001 := &proxyproto.Listener{Listener: t5001}
-
-	resolver := midway.NewDohStub(env.UpstreamDoh())
-
-	// proxyproto listener works with plain tcp, too
-	go midway.StartPP(pp80, hold)
-	go midway.StartPPWithDoH(pp443, resolver, hold)
-	go midway.StartPPWithDoT(pp853, resolver, hold)
-	go midway.StartPPWithDoHCleartext(pp1443, resolver, hold)
-	go midway.StartPPWithDoTCleartext(pp1853, resolver, hold)
 	// echo servers on tcp and udp
-	go midway.EchoUDP(u5000, hold)
-	go midway.EchoTCP(t5000, hold)
-	go midway.EchoPP(pp5001, hold)
-
-	hold.Wait()
-}
+	midway.Supervise("echo-udp", false, func() error {
+		// ref: fly.io/docs/app-guides/udp-and-tcp/
+		u5000, err := net.ListenPacket("udp", "fly-global-services:5000")
+		if err != nil {
+			log.Println(err)
+			if u5000, err = net.ListenPacket("udp", portmap["echo"]); err != nil {
+				return err
+			}
+		}
+		fmt.Println("started: udp-server on port ", portmap["echo"])
+		return midway.EchoUDP(u5000)
+	})
+	midway.Supervise("echo-tcp", false, func() error {
+		t5000, err := net.Listen("tcp", portmap["echo"])
+		if err != nil {
+			return err
+		}
+		fmt.Println("started: tcp-server on port ", portmap["echo"])
+		return midway.EchoTCP(t5000)
+	})
+	midway.Supervise("ppecho", false, pp(portmap["ppecho"], midway.EchoPP))
+	// state of each listener, on the private network alone
+	midway.Supervise("status", false, func() error {
+		// ref: fly.io/docs/networking/private-networking/
+		l, err := net.Listen("tcp", "fly-local-6pn"+portmap["status"])
+		if err != nil {
+			log.Println(err)
+			if l, err = net.Listen("tcp", "127.0.0.1"+portmap["status"]); err != nil {
+				return err
+			}
+		}
+		fmt.Println("started: status-server on port ", portmap["status"])
+		return midway.StartStatus(l)
+	})
+
+	// fly sends SIGINT (see kill_signal in fly.toml) before it SIGKILLs
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	code := 0
+	select {
+	case sig := <-sigs:
+		log.Print("main: shutting down on ", sig)
+	case err := <-midway.Fatal():
+		// exit, so that fly restarts this machine
+		log.Print("main: shutting down; ", err)
+		code = 1
+	}
 
-func barrier(count int) *sync.WaitGroup {
-	w := &sync.WaitGroup{}
-	w.Add(count)
-	return w
+	ctx, cancel := context.WithTimeout(context.Background(), env.ShutdownTimeoutSec())
+	midway.Shutdown(ctx)
+	cancel()
+	os.Exit(code)
 }
 
-func ko(err error) {
-	if err != nil {
-		log.Fatal(err)
+// pp returns a fn that listens on addr and serves proxyproto conns
+// with serve, for the supervisor to run (and re-run).
+func pp(addr string, serve func(*proxyproto.Listener) error) func() error {
+	return func() error {
+		t, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		fmt.Println("started: pptcp-server on port ", addr)
+		return serve(&proxyproto.Listener{Listener: t})
 	}
 }
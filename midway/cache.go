@@ -0,0 +1,280 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	cacheShards = 32
+	// answers are cached for no longer than maxCacheTTL
+	maxCacheTTL = 24 * time.Hour
+	// entries hit at least prefetchHits times are refreshed when they
+	// are hit in the last prefetchWindow of their ttl (say, 10%)
+	prefetchHits    = 2
+	prefetchWindow  = 10
+	prefetchTimeout = 5 * time.Second
+)
+
+// trace is what middleware learn about a query, for Log to log
+type trace struct {
+	cache string // "hit", "hit; prefetch", "miss", or empty if uncached
+}
+
+type traceKey struct{}
+
+func traceOf(ctx context.Context) *trace {
+	if t, ok := ctx.Value(traceKey{}).(*trace); ok {
+		return t
+	}
+	return &trace{}
+}
+
+type centry struct {
+	key      string
+	msg      *dns.Msg
+	stored   time.Time
+	ttl      time.Duration
+	hits     int
+	fetching bool
+	elem     *list.Element
+}
+
+type cshard struct {
+	mu  sync.Mutex
+	max int
+	all map[string]*centry
+	lru *list.List // front is the most recently used
+}
+
+type cache struct {
+	next   Resolver
+	shards [cacheShards]*cshard
+}
+
+// Cache answers queries from answers to prior queries, of which it
+// keeps up to size, for as long as their least ttl (or, for negative
+// answers, as long as their SOA says; rfc2308 5); and refreshes popular
+// answers just before they expire. Queries are keyed on their question,
+// DO bit, and client subnet (ECS).
+func Cache(size int) Middleware {
+	return func(next Resolver) Resolver {
+		if size <= 0 {
+			return next
+		}
+		c := &cache{next: next}
+		per := size / cacheShards
+		if per <= 0 {
+			per = 1
+		}
+		for i := range c.shards {
+			c.shards[i] = &cshard{max: per, all: make(map[string]*centry), lru: list.New()}
+		}
+		return c
+	}
+}
+
+func (c *cache) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	key, ok := cacheKey(q)
+	if !ok {
+		return c.next.Resolve(ctx, q)
+	}
+	sh := c.shard(key)
+	tr := traceOf(ctx)
+
+	now := time.Now()
+	sh.mu.Lock()
+	e, hit := sh.all[key]
+	if hit && now.Sub(e.stored) >= e.ttl {
+		sh.remove(e)
+		hit = false
+	}
+	var prefetch bool
+	var a *dns.Msg
+	if hit {
+		e.hits++
+		sh.lru.MoveToFront(e.elem)
+		left := e.ttl - now.Sub(e.stored)
+		prefetch = !e.fetching && e.hits >= prefetchHits && left*prefetchWindow <= e.ttl
+		if prefetch {
+			e.fetching = true
+		}
+		a = aged(e.msg, now.Sub(e.stored))
+	}
+	sh.mu.Unlock()
+
+	if hit {
+		tr.cache = "hit"
+		if prefetch {
+			tr.cache = "hit; prefetch"
+			go c.prefetch(key, q.Copy())
+		}
+		a.Id = q.Id
+		a.Question = q.Question
+		return a, nil
+	}
+
+	tr.cache = "miss"
+	a, err := c.next.Resolve(ctx, q)
+	if err == nil {
+		c.store(key, a, 0)
+	}
+	return a, err
+}
+
+// prefetch refreshes the entry for key by resolving q anew
+func (c *cache) prefetch(key string, q *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+	a, err := c.next.Resolve(ctx, q)
+	if err != nil {
+		sh := c.shard(key)
+		sh.mu.Lock()
+		if e, ok := sh.all[key]; ok {
+			e.fetching = false
+		}
+		sh.mu.Unlock()
+		return
+	}
+	// refreshed entries stay popular
+	c.store(key, a, prefetchHits)
+}
+
+// store caches a for key, if it is cacheable
+func (c *cache) store(key string, a *dns.Msg, hits int) {
+	ttl, ok := cacheTTL(a)
+	if !ok {
+		return
+	}
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if e, ok := sh.all[key]; ok {
+		sh.remove(e)
+	}
+	e := &centry{key: key, msg: a.Copy(), stored: time.Now(), ttl: ttl, hits: hits}
+	e.elem = sh.lru.PushFront(e)
+	sh.all[key] = e
+	for sh.lru.Len() > sh.max {
+		sh.remove(sh.lru.Back().Value.(*centry))
+	}
+}
+
+func (sh *cshard) remove(e *centry) {
+	sh.lru.Remove(e.elem)
+	delete(sh.all, e.key)
+}
+
+func (c *cache) shard(key string) *cshard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return c.shards[h.Sum32()%cacheShards]
+}
+
+// cacheKey keys q on its question, DO bit, and ECS, if it has just the
+// one question
+func cacheKey(q *dns.Msg) (string, bool) {
+	if len(q.Question) != 1 {
+		return "", false
+	}
+	qq := q.Question[0]
+	var b strings.Builder
+	b.WriteString(strings.ToLower(qq.Name))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(qq.Qtype)))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(qq.Qclass)))
+	if q.CheckingDisabled {
+		b.WriteString("|cd")
+	}
+	if opt := q.IsEdns0(); opt != nil {
+		if opt.Do() {
+			b.WriteString("|do")
+		}
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				b.WriteString("|ecs=")
+				b.WriteString(ecs.String())
+			}
+		}
+	}
+	return b.String(), true
+}
+
+// cacheTTL is how long a may be cached for: its least ttl, or for
+// NXDOMAIN and NODATA answers, that of their SOA (rfc2308 5); and
+// false if a isn't to be cached at all.
+func cacheTTL(a *dns.Msg) (time.Duration, bool) {
+	if a == nil || a.Truncated {
+		return 0, false
+	}
+	negative := a.Rcode == dns.RcodeNameError || (a.Rcode == dns.RcodeSuccess && len(a.Answer) <= 0)
+	if a.Rcode != dns.RcodeSuccess && !negative {
+		return 0, false // servfails, refusals, and such
+	}
+
+	var least uint32
+	found := false
+	consider := func(ttl uint32) {
+		if !found || ttl < least {
+			least, found = ttl, true
+		}
+	}
+	if negative {
+		for _, rr := range a.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				consider(soa.Hdr.Ttl)
+				consider(soa.Minttl)
+			}
+		}
+	} else {
+		for _, rrs := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+			for _, rr := range rrs {
+				if rr.Header().Rrtype != dns.TypeOPT {
+					consider(rr.Header().Ttl)
+				}
+			}
+		}
+	}
+	if !found || least <= 0 {
+		return 0, false
+	}
+	ttl := time.Duration(least) * time.Second
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+	return ttl, true
+}
+
+// aged copies m with the ttls of its records less age
+func aged(m *dns.Msg, age time.Duration) *dns.Msg {
+	a := m.Copy()
+	secs := uint32(age / time.Second)
+	for _, rrs := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl > secs {
+				h.Ttl -= secs
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+	return a
+}
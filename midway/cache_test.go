@@ -0,0 +1,296 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func rrA(name string, ttl uint32) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.IPv4(192, 0, 2, 1),
+	}
+}
+
+func rrSOA(ttl, minttl uint32) dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:  "ns.example.", Mbox: "hostmaster.example.", Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400,
+		Minttl: minttl,
+	}
+}
+
+func reply(rcode int, ans, ns []dns.RR) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetRcode(query("cache.example"), rcode)
+	a.Answer, a.Ns = ans, ns
+	a.SetEdns0(1232, false)
+	return a
+}
+
+func TestCacheTTL(t *testing.T) {
+	truncated := reply(dns.RcodeSuccess, []dns.RR{rrA("a", 60)}, nil)
+	truncated.Truncated = true
+
+	tests := []struct {
+		name string
+		a    *dns.Msg
+		ttl  time.Duration // 0 if not cached
+	}{
+		{"least of answers", reply(dns.RcodeSuccess, []dns.RR{rrA("a", 300), rrA("a", 60)}, nil), 60 * time.Second},
+		{"least of all sections", reply(dns.RcodeSuccess, []dns.RR{rrA("a", 300)}, []dns.RR{rrSOA(30, 900)}), 30 * time.Second},
+		{"capped", reply(dns.RcodeSuccess, []dns.RR{rrA("a", 7*86400)}, nil), maxCacheTTL},
+		{"zero ttl", reply(dns.RcodeSuccess, []dns.RR{rrA("a", 0)}, nil), 0},
+		{"nxdomain, soa minimum", reply(dns.RcodeNameError, nil, []dns.RR{rrSOA(3600, 300)}), 300 * time.Second},
+		{"nxdomain, soa ttl", reply(dns.RcodeNameError, nil, []dns.RR{rrSOA(120, 300)}), 120 * time.Second},
+		{"nodata, soa minimum", reply(dns.RcodeSuccess, nil, []dns.RR{rrSOA(3600, 60)}), 60 * time.Second},
+		{"nxdomain sans soa", reply(dns.RcodeNameError, nil, nil), 0},
+		{"nodata sans soa", reply(dns.RcodeSuccess, nil, nil), 0},
+		{"servfail", reply(dns.RcodeServerFailure, nil, []dns.RR{rrSOA(3600, 300)}), 0},
+		{"refused", reply(dns.RcodeRefused, nil, nil), 0},
+		{"truncated", truncated, 0},
+		{"nil", nil, 0},
+	}
+	for _, tc := range tests {
+		ttl, ok := cacheTTL(tc.a)
+		if ok != (tc.ttl > 0) || ttl != tc.ttl {
+			t.Errorf("%s: want %s; got %s (cached %t)", tc.name, tc.ttl, ttl, ok)
+		}
+	}
+}
+
+func TestAged(t *testing.T) {
+	m := reply(dns.RcodeSuccess, []dns.RR{rrA("a", 60), rrA("a", 5)}, nil)
+	a := aged(m, 10*time.Second+500*time.Millisecond)
+	if a.Answer[0].Header().Ttl != 50 || a.Answer[1].Header().Ttl != 0 {
+		t.Fatalf("want ttls 50 and 0; got %d and %d", a.Answer[0].Header().Ttl, a.Answer[1].Header().Ttl)
+	}
+	if m.Answer[0].Header().Ttl != 60 {
+		t.Fatal("want the cached msg as-is")
+	}
+	if opt := a.IsEdns0(); opt == nil || opt.UDPSize() != 1232 {
+		t.Fatal("want the opt rr as-is")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	key := func(q *dns.Msg) string {
+		k, ok := cacheKey(q)
+		if !ok {
+			t.Fatal("want q cacheable")
+		}
+		return k
+	}
+	base := key(query("Cache.Example"))
+	if key(query("cache.example.")) != base {
+		t.Fatal("want keys case-insensitive")
+	}
+
+	do := query("cache.example")
+	do.SetEdns0(1232, true)
+	cd := query("cache.example")
+	cd.CheckingDisabled = true
+	ecs := func(ip string) *dns.Msg {
+		q := query("cache.example")
+		q.SetEdns0(1232, false)
+		q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(ip).To4(),
+		})
+		return q
+	}
+	aaaa := query("cache.example")
+	aaaa.Question[0].Qtype = dns.TypeAAAA
+
+	seen := map[string]string{base: "base"}
+	for name, q := range map[string]*dns.Msg{
+		"do": do, "cd": cd, "ecs1": ecs("192.0.2.0"), "ecs2": ecs("198.51.100.0"), "aaaa": aaaa,
+	} {
+		k := key(q)
+		if prior, ok := seen[k]; ok {
+			t.Fatalf("%s and %s share key %s", name, prior, k)
+		}
+		seen[k] = name
+	}
+
+	two := query("cache.example")
+	two.Question = append(two.Question, two.Question[0])
+	if _, ok := cacheKey(two); ok {
+		t.Fatal("want queries of many questions uncached")
+	}
+}
+
+// counting answers queries with a as set, and counts queries asked
+type counting struct {
+	asked int32
+	a     atomic.Pointer[dns.Msg]
+}
+
+func (u *counting) Resolve(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.asked, 1)
+	a := u.a.Load().Copy()
+	a.Id = q.Id
+	a.Question = q.Question
+	return a, nil
+}
+
+func (u *counting) n() int32 { return atomic.LoadInt32(&u.asked) }
+
+// backdate ages the entry for q in c by d
+func backdate(t *testing.T, c *cache, q *dns.Msg, d time.Duration) {
+	t.Helper()
+	key, _ := cacheKey(q)
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e, ok := sh.all[key]
+	if !ok {
+		t.Fatal("want q cached")
+	}
+	e.stored = e.stored.Add(-d)
+}
+
+func TestCacheResolve(t *testing.T) {
+	up := &counting{}
+	up.a.Store(reply(dns.RcodeSuccess, []dns.RR{rrA("cache.example", 60)}, nil))
+	c := Cache(1024)(up).(*cache)
+	ctx := context.Background()
+	q := query("cache.example")
+
+	tr := &trace{}
+	if _, err := c.Resolve(context.WithValue(ctx, traceKey{}, tr), q); err != nil || tr.cache != "miss" {
+		t.Fatalf("want a miss; got %q (err %v)", tr.cache, err)
+	}
+
+	// hits are answered with the ttl left, and the id of the query
+	backdate(t, c, q, 10*time.Second)
+	q2 := query("CACHE.example")
+	q2.Id = q.Id + 1
+	tr = &trace{}
+	a, err := c.Resolve(context.WithValue(ctx, traceKey{}, tr), q2)
+	if err != nil || tr.cache != "hit" || up.n() != 1 {
+		t.Fatalf("want a hit; got %q, asked %d (err %v)", tr.cache, up.n(), err)
+	}
+	if a.Id != q2.Id || a.Question[0].Name != q2.Question[0].Name || a.Answer[0].Header().Ttl != 50 {
+		t.Fatalf("want id %d, name %s, ttl 50; got %d, %s, %d", q2.Id, q2.Question[0].Name, a.Id, a.Question[0].Name, a.Answer[0].Header().Ttl)
+	}
+
+	// expired entries are fetched anew
+	backdate(t, c, q, time.Minute)
+	if _, _ = c.Resolve(ctx, q); up.n() != 2 {
+		t.Fatalf("want expired entries fetched anew; asked %d", up.n())
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	up := &counting{}
+	up.a.Store(reply(dns.RcodeNameError, nil, []dns.RR{rrSOA(3600, 30)}))
+	c := Cache(1024)(up).(*cache)
+	q := query("nx.example")
+
+	for i := 0; i < 3; i++ {
+		a, err := c.Resolve(context.Background(), q)
+		if err != nil || a.Rcode != dns.RcodeNameError {
+			t.Fatalf("want NXDOMAIN; got %v (err %v)", a, err)
+		}
+	}
+	if up.n() != 1 {
+		t.Fatalf("want NXDOMAIN cached; asked %d", up.n())
+	}
+	// for as long as the soa minimum
+	backdate(t, c, q, 30*time.Second)
+	if _, _ = c.Resolve(context.Background(), q); up.n() != 2 {
+		t.Fatalf("want NXDOMAIN expired after the soa minimum; asked %d", up.n())
+	}
+
+	// servfails aren't cached
+	up.a.Store(reply(dns.RcodeServerFailure, nil, nil))
+	sf := query("sf.example")
+	_, _ = c.Resolve(context.Background(), sf)
+	_, _ = c.Resolve(context.Background(), sf)
+	if up.n() != 4 {
+		t.Fatalf("want SERVFAIL uncached; asked %d", up.n()-2)
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	up := &counting{}
+	up.a.Store(reply(dns.RcodeSuccess, []dns.RR{rrA("hot.example", 100)}, nil))
+	c := Cache(1024)(up).(*cache)
+	q := query("hot.example")
+	ctx := context.Background()
+
+	_, _ = c.Resolve(ctx, q)
+	// hit prefetchHits times, but not in the last 10% of the ttl
+	backdate(t, c, q, 50*time.Second)
+	for i := 0; i < prefetchHits; i++ {
+		_, _ = c.Resolve(ctx, q)
+	}
+	if up.n() != 1 {
+		t.Fatalf("want no prefetch early on; asked %d", up.n())
+	}
+
+	// popular, and in the last 10% of its ttl
+	backdate(t, c, q, 45*time.Second)
+	tr := &trace{}
+	a, _ := c.Resolve(context.WithValue(ctx, traceKey{}, tr), q)
+	if tr.cache != "hit; prefetch" || a.Answer[0].Header().Ttl != 5 {
+		t.Fatalf("want a hit, with ttl 5, that prefetches; got %q, ttl %d", tr.cache, a.Answer[0].Header().Ttl)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for up.n() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if up.n() != 2 {
+		t.Fatalf("want a prefetch; asked %d", up.n())
+	}
+
+	// the refreshed entry is served with its full ttl
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if a, _ = c.Resolve(ctx, q); a.Answer[0].Header().Ttl == 100 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if a.Answer[0].Header().Ttl != 100 || up.n() != 2 {
+		t.Fatalf("want the prefetched answer; got ttl %d, asked %d", a.Answer[0].Header().Ttl, up.n())
+	}
+}
+
+func TestCacheEvictsLRU(t *testing.T) {
+	up := &counting{}
+	up.a.Store(reply(dns.RcodeSuccess, []dns.RR{rrA("lru.example", 60)}, nil))
+	c := Cache(1024)(up).(*cache)
+	// one shard of 2, so that evictions are deterministic
+	sh := &cshard{max: 2, all: make(map[string]*centry), lru: list.New()}
+	for i := range c.shards {
+		c.shards[i] = sh
+	}
+	ctx := context.Background()
+
+	a, b, x := query("a.example"), query("b.example"), query("x.example")
+	_, _ = c.Resolve(ctx, a)
+	_, _ = c.Resolve(ctx, b)
+	_, _ = c.Resolve(ctx, a) // a is now the most recent
+	_, _ = c.Resolve(ctx, x) // evicts b
+	if up.n() != 3 || len(sh.all) != 2 {
+		t.Fatalf("want 3 asked, 2 cached; got %d, %d", up.n(), len(sh.all))
+	}
+	if _, _ = c.Resolve(ctx, a); up.n() != 3 {
+		t.Fatal("want a cached")
+	}
+	if _, _ = c.Resolve(ctx, b); up.n() != 4 {
+		t.Fatal("want b evicted")
+	}
+}
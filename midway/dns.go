@@ -7,10 +7,14 @@ package midway
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,17 +23,45 @@ import (
 // Adopted from: github.com/folbricht/routedns
 
 type DohResolver interface {
+	Resolver
+	// DnsHandler serves dns over tcp / tls with Resolve
 	DnsHandler() dns.HandlerFunc
+	// DohHandler serves dns over https with Resolve
 	DohHandler() http.HandlerFunc
+	// LookupNetIP resolves host to its ip4 ("ip4"), ip6 ("ip6"),
+	// or all ("ip") addrs; as net.Resolver does.
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
 }
 
+var errNoAns = errors.New("doh: no answer")
+
 type dohstub struct {
+	r  Resolver // upstreams wrapped in middleware
+	lr Resolver // upstreams wrapped in the cache alone, if any
+}
+
+// dohUpstream resolves queries over DoH
+type dohUpstream struct {
 	url string
 	doh *http.Client
-	DohResolver
 }
 
-func NewDohStub(url string) DohResolver {
+// NewDohStub resolves queries with up (see NewUpstreams), through mws,
+// if any; see Chain and Middlewares. Its own lookups (LookupNetIP) go
+// through the cache alone, if mws has one in it, and if last, as in
+// Middlewares.
+func NewDohStub(up Resolver, mws ...Middleware) DohResolver {
+	s := &dohstub{r: up, lr: up}
+	for i := len(mws) - 1; i >= 0; i-- {
+		s.r = mws[i](s.r)
+		if c, ok := s.r.(*cache); ok {
+			s.lr = c
+		}
+	}
+	return s
+}
+
+func newDohUpstream(url string) *dohUpstream {
 	tr := &http.Transport{
 		ResponseHeaderTimeout: 10 * time.Second,
 		IdleConnTimeout:       30 * time.Second,
@@ -37,22 +69,32 @@ func NewDohStub(url string) DohResolver {
 	hc := &http.Client{
 		Transport: tr,
 	}
-	return &dohstub{url: url, doh: hc}
+	return &dohUpstream{url: url, doh: hc}
+}
+
+func (s *dohstub) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) <= 0 {
+		return nil, errNoQuestion
+	}
+	return s.r.Resolve(ctx, q)
+}
+
+// resolve is Resolve, but answers SERVFAIL on errors
+func (s *dohstub) resolve(ctx context.Context, q *dns.Msg) *dns.Msg {
+	a, err := s.Resolve(ctx, q)
+	if err != nil || a == nil {
+		return s.servfail(q)
+	}
+	return a
 }
 
 func (s *dohstub) DnsHandler() dns.HandlerFunc {
 	return func(w dns.ResponseWriter, msg *dns.Msg) {
-		ans := s.servfail(msg)
-		defer func() {
-			_ = w.WriteMsg(ans)
-			w.Close()
-		}()
-
-		if q, err := msg.Pack(); err == nil {
-			if x := s.dodoh(q); x != nil {
-				ans = x
-			}
-		}
+		ctx, cancel := context.WithTimeout(context.Background(), conntimeout)
+		defer cancel()
+		ans := s.resolve(ctx, msg)
+		_ = w.WriteMsg(ans)
+		w.Close()
 	}
 }
 
@@ -60,10 +102,6 @@ func (s *dohstub) servfail(q *dns.Msg) *dns.Msg {
 	return responseWithCode(q, dns.RcodeServerFailure)
 }
 
-func (s *dohstub) refused(q *dns.Msg) *dns.Msg {
-	return responseWithCode(q, dns.RcodeRefused)
-}
-
 func responseWithCode(q *dns.Msg, rcode int) *dns.Msg {
 	a := new(dns.Msg)
 	a.SetRcode(q, rcode)
@@ -118,14 +156,7 @@ func (s *dohstub) upstreamDNS(b []byte, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var err error
-	a := s.dodoh(b)
-
-	// A nil response from the resolvers means "drop", return blank response
-	if a == nil {
-		w.WriteHeader(http.StatusForbidden)
-		return
-	}
+	a := s.resolve(r.Context(), q)
 
 	// Pad the packet according to rfc8467 and rfc7830
 	// TODO: padAnswer(q, a)
@@ -141,11 +172,16 @@ func (s *dohstub) upstreamDNS(b []byte, w http.ResponseWriter, r *http.Request)
 	_, _ = w.Write(out)
 }
 
+// Resolve sends q to the upstream doh resolver, and returns its answer
 // TODO: rm query-id before request and restore after response
-func (s *dohstub) dodoh(b []byte) *dns.Msg {
-	req, err := http.NewRequest("POST", s.url, bytes.NewReader(b))
+func (s *dohUpstream) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	b, err := q.Pack()
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
 	}
 
 	req.Header.Add("accept", "application/dns-message")
@@ -154,40 +190,79 @@ func (s *dohstub) dodoh(b []byte) *dns.Msg {
 	res, err := s.doh.Do(req)
 
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		return nil
+		return nil, fmt.Errorf("%w: status %d", errNoUpstream, res.StatusCode)
 	}
 
 	ans, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	x := new(dns.Msg)
-	if err = x.Unpack(ans); err == nil {
-		log.Printf("doh: q0 %s => a0 %s | len(ans): %d", s.querystr(x), s.ansstr(x), len(x.Answer))
-		return x
+	if err = x.Unpack(ans); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return x, nil
 }
 
-func (s *dohstub) querystr(m *dns.Msg) string {
-	if m == nil || m.Question == nil || len(m.Question) <= 0 {
-		return "no-query"
-	} else {
-		return m.Question[0].String()
+// LookupNetIP resolves host for the relay; and not for clients, and so,
+// sans client-facing middleware: lookups aren't logged, limited, blocked,
+// or rewritten.
+func (s *dohstub) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var qtypes []uint16
+	switch network {
+	case "ip4":
+		qtypes = []uint16{dns.TypeA}
+	case "ip6":
+		qtypes = []uint16{dns.TypeAAAA}
+	default:
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
 	}
+
+	ans := make(chan []netip.Addr, len(qtypes))
+	for _, qtyp := range qtypes {
+		go func(qtyp uint16) {
+			ans <- s.lookup(ctx, host, qtyp)
+		}(qtyp)
+	}
+
+	var ips []netip.Addr
+	for range qtypes {
+		ips = append(ips, <-ans...)
+	}
+	if len(ips) <= 0 {
+		return nil, &net.DNSError{Err: errNoAns.Error(), Name: host, IsNotFound: true}
+	}
+	return ips, nil
 }
 
-func (s *dohstub) ansstr(m *dns.Msg) string {
-	if m == nil || m.Answer == nil || len(m.Answer) <= 0 {
-		return "no-ans"
-	} else {
-		return m.Answer[0].String()
+func (s *dohstub) lookup(ctx context.Context, host string, qtyp uint16) []netip.Addr {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(host), qtyp)
+	a, err := s.lr.Resolve(ctx, q)
+	if err != nil || a.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	var ips []netip.Addr
+	for _, rr := range a.Answer {
+		var ip net.IP
+		switch x := rr.(type) {
+		case *dns.A:
+			ip = x.A
+		case *dns.AAAA:
+			ip = x.AAAA
+		default:
+			continue // cnames and such
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			ips = append(ips, addr.Unmap())
+		}
 	}
+	return ips
 }
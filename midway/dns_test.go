@@ -0,0 +1,53 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupNetIPSkipsMiddleware(t *testing.T) {
+	var asked int32
+	up := ResolverFunc(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&asked, 1)
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = append(a.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+		return a, nil
+	})
+	s := NewDohStub(up, Block([]string{"relay.example"}), Cache(64))
+
+	// clients are blocked
+	a, err := s.Resolve(context.Background(), query("relay.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Rcode != dns.RcodeNameError || asked != 0 {
+		t.Fatalf("want NXDOMAIN sans asking upstream; got %s, asked %d", dns.RcodeToString[a.Rcode], asked)
+	}
+
+	// the relay is not, and its answers are cached
+	for i := 0; i < 2; i++ {
+		ips, err := s.LookupNetIP(context.Background(), "ip4", "relay.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || ips[0].String() != "127.0.0.1" {
+			t.Fatalf("want 127.0.0.1; got %v", ips)
+		}
+	}
+	if n := atomic.LoadInt32(&asked); n != 1 {
+		t.Fatalf("want lookups cached; upstream asked %d times", n)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/celzero/gateway/midway/env"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// doq error codes, rfc9250 4.3
+	doqNoError       = 0x0
+	doqProtocolError = 0x2
+	// doq conns idle for doqIdle are closed
+	doqIdle = 30 * time.Second
+	// alpn for doq, rfc9250 4.1.1
+	doqALPN = "doq"
+)
+
+var errDoQID = errors.New("doq: query id not 0")
+
+// StartDoQ serves DNS over QUIC (rfc9250) on pc with doh, a query to
+// a stream, and with the certs DoT and DoH are served with.
+func StartDoQ(pc net.PacketConn, doh DohResolver) error {
+	if pc == nil {
+		log.Print("Exiting doq")
+		return errNoListener
+	}
+	tlsconf := env.TlsConfig()
+	if tlsconf == nil {
+		pc.Close()
+		log.Print("Exiting doq; no certs")
+		return errNoListener
+	}
+	tlsconf.NextProtos = []string{doqALPN}
+
+	tr := &quic.Transport{Conn: pc}
+	ln, err := tr.Listen(tlsconf, &quic.Config{
+		MaxIdleTimeout:     doqIdle,
+		MaxIncomingStreams: maxInflightQueries,
+	})
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	log.Print("mode: DoQ ", pc.LocalAddr().String())
+
+	inflight := &doqStreams{}
+	atShutdown("doq "+pc.LocalAddr().String(), func(ctx context.Context) error {
+		err := ln.Close()
+		done := make(chan struct{})
+		go func() {
+			inflight.wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		tr.Close()
+		pc.Close()
+		return err
+	})
+
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			log.Print("exit doq: ", err)
+			// at shutdown, streams in-flight are waited on, and then
+			// tr closed; else, pc is freed up for a restart
+			if !inflight.stopping() {
+				tr.Close()
+				pc.Close()
+			}
+			return err
+		}
+		go serveDoQ(conn, doh, inflight)
+	}
+}
+
+// doqStreams are doq streams being answered
+type doqStreams struct {
+	mu   sync.Mutex
+	wg   sync.WaitGroup
+	stop bool
+}
+
+// add tracks a stream, unless waited on, in which case it returns false
+func (s *doqStreams) add() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *doqStreams) done() { s.wg.Done() }
+
+// stopping tells whether s is being, or was, waited on
+func (s *doqStreams) stopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stop
+}
+
+// wait stops tracking streams, and waits for the ones tracked to finish
+func (s *doqStreams) wait() {
+	s.mu.Lock()
+	s.stop = true
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// serveDoQ answers queries on conn, one to each stream it opens
+func serveDoQ(conn quic.Connection, doh DohResolver, inflight *doqStreams) {
+	for {
+		st, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return // conn closed, or idle
+		}
+		if !inflight.add() {
+			// shutting down
+			st.CancelRead(doqNoError)
+			st.CancelWrite(doqNoError)
+			return
+		}
+		go func() {
+			defer inflight.done()
+			err := serveDoQStream(conn.Context(), st, doh)
+			if errors.Is(err, errDoQID) {
+				_ = conn.CloseWithError(doqProtocolError, err.Error())
+			}
+			if err != nil {
+				log.Printf("doq: %s; err %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// serveDoQStream reads the one query on st, and writes its answer, both
+// prefixed with their length (rfc9250 4.2); and then closes st.
+func serveDoQStream(ctx context.Context, st quic.Stream, doh DohResolver) error {
+	defer st.Close()
+	ctx, cancel := context.WithTimeout(ctx, conntimeout)
+	defer cancel()
+	_ = st.SetDeadline(time.Now().Add(conntimeout))
+
+	q, err := readPrefixed(st)
+	if err != nil {
+		st.CancelRead(doqProtocolError)
+		return err
+	}
+	if q.Id != 0 {
+		// rfc9250 4.2.1
+		return errDoQID
+	}
+	a, err := doh.Resolve(ctx, q)
+	if err != nil || a == nil {
+		a = responseWithCode(q, dns.RcodeServerFailure)
+	}
+	a.Id = 0
+	return writePrefixed(st, a)
+}
+
+// readPrefixed reads a dns msg prefixed with its length from r
+func readPrefixed(r io.Reader) (*dns.Msg, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writePrefixed writes m prefixed with its length to w
+func writePrefixed(w io.Writer, m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	out := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(out, uint16(len(b)))
+	_, err = w.Write(append(out, b...))
+	return err
+}
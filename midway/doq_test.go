@@ -0,0 +1,37 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDoQStreamsWait(t *testing.T) {
+	s := &doqStreams{}
+	if !s.add() {
+		t.Fatal("want streams tracked")
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		s.wait()
+		close(waited)
+	}()
+	for !s.stopping() {
+		time.Sleep(time.Millisecond)
+	}
+	if s.add() {
+		t.Fatal("want no streams tracked once waited on")
+	}
+	select {
+	case <-waited:
+		t.Fatal("want wait to wait for the stream tracked")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.done()
+	<-waited
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"strings"
+
+	"github.com/celzero/gateway/midway/env"
+	"github.com/celzero/gateway/midway/relay"
+	"github.com/miekg/dns"
+)
+
+var echdomains = env.ECHDomains()
+
+// wantsECH tells whether q is an HTTPS query for any of ECH_DOMAINS,
+// while midway has an ECHConfigList. Answers to queries with the DO bit
+// are left as-is, as changing them invalidates their RRSIGs.
+func wantsECH(q *dns.Msg) bool {
+	if len(q.Question) <= 0 || len(relay.ECHConfigList()) <= 0 {
+		return false
+	}
+	if o := q.IsEdns0(); o != nil && o.Do() {
+		return false
+	}
+	qq := q.Question[0]
+	return qq.Qtype == dns.TypeHTTPS && echDomain(qq.Name)
+}
+
+// withECH adds midway's ECHConfigList to HTTPS records in a, the answer
+// to a query that wantsECH, so that clients encrypt their hellos to
+// midway. Answers sans HTTPS records are left as-is, as midway knows
+// neither the alpn nor the addrs of the service to fill one in with.
+func withECH(a *dns.Msg) *dns.Msg {
+	ech := relay.ECHConfigList()
+	if a == nil || len(ech) <= 0 || a.Rcode != dns.RcodeSuccess {
+		return a
+	}
+	for _, rr := range a.Answer {
+		h, ok := rr.(*dns.HTTPS)
+		if !ok || h.Priority == 0 {
+			continue // alias mode; sans params
+		}
+		kvs := h.Value[:0]
+		for _, kv := range h.Value {
+			if kv.Key() != dns.SVCB_ECHCONFIG {
+				kvs = append(kvs, kv)
+			}
+		}
+		h.Value = append(kvs, &dns.SVCBECHConfig{ECH: ech})
+	}
+	return a
+}
+
+// echDomain tells whether name is any of ECH_DOMAINS or their subdomains
+func echDomain(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, d := range echdomains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -22,14 +22,14 @@ var (
 	udproutines = env.TotalUdpServerRoutines()
 )
 
-func EchoUDP(c net.PacketConn, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+func EchoUDP(c net.PacketConn) error {
 	if c == nil {
 		log.Println("Exiting udp")
-		return
+		return errNoListener
 	}
 
+	atShutdown("echo udp "+c.LocalAddr().String(), closer(c))
+
 	udpwg := &sync.WaitGroup{}
 	udpwg.Add(udproutines)
 	for i := 0; i < udproutines; i++ {
@@ -37,6 +37,8 @@ func EchoUDP(c net.PacketConn, wg *sync.WaitGroup) {
 		go processudp(c, udpwg)
 	}
 	udpwg.Wait()
+	// processudp only ever exits once c is closed
+	return net.ErrClosed
 }
 
 func processudp(c net.PacketConn, uwg *sync.WaitGroup) {
@@ -62,15 +64,14 @@ func processudp(c net.PacketConn, uwg *sync.WaitGroup) {
 	}
 }
 
-func EchoTCP(tcp net.Listener, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+func EchoTCP(tcp net.Listener) error {
 	if tcp == nil {
 		log.Println("Exiting tcp")
-		return
+		return errNoListener
 	}
 
 	defer tcp.Close()
+	atShutdown("echo tcp "+tcp.Addr().String(), closer(tcp))
 
 	for {
 		if conn, err := tcp.Accept(); err == nil {
@@ -79,21 +80,20 @@ func EchoTCP(tcp net.Listener, wg *sync.WaitGroup) {
 			fmt.Println("err accepting tcp conn")
 			if errors.Is(err, net.ErrClosed) {
 				log.Print(err)
-				return
+				return err
 			}
 		}
 	}
 }
 
-func EchoPP(pp *proxyproto.Listener, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+func EchoPP(pp *proxyproto.Listener) error {
 	if pp == nil {
 		log.Println("Exiting pp")
-		return
+		return errNoListener
 	}
 
 	defer pp.Close()
+	atShutdown("echo pp "+pp.Addr().String(), closer(pp))
 
 	for {
 		if conn, err := pp.Accept(); err == nil {
@@ -102,7 +102,7 @@ func EchoPP(pp *proxyproto.Listener, wg *sync.WaitGroup) {
 			fmt.Println("err accepting proxy-proto conn")
 			if errors.Is(err, net.ErrClosed) {
 				log.Print(err)
-				return
+				return err
 			}
 		}
 	}
@@ -25,12 +25,75 @@ func NoProxyTimeoutSec() time.Duration {
 	return time.Second * time.Duration(timeoutsec)
 }
 
+// RelayIdleTimeoutSec is how long a relayed conn may go without a byte
+// read or written, either way; 0 for no timeout. Idle timeouts need
+// deadlines set per read and write, and so relayed bytes are copied
+// in userspace, and not spliced, unless this is 0.
+func RelayIdleTimeoutSec() time.Duration {
+	timeoutsec := intenv("RELAY_IDLE_TIMEOUT_SEC", 300)
+	return time.Second * time.Duration(timeoutsec)
+}
+
+// RelayMaxLifetimeSec is how long a relayed conn may last, however
+// busy; 0 for no limit
+func RelayMaxLifetimeSec() time.Duration {
+	lifetimesec := intenv("RELAY_MAX_LIFETIME_SEC", 0)
+	return time.Second * time.Duration(lifetimesec)
+}
+
+// ShutdownTimeoutSec is how long in-flight conns are given to finish
+// on shutdown; keep it under fly.toml's kill_timeout
+func ShutdownTimeoutSec() time.Duration {
+	timeoutsec := intenv("SHUTDOWN_TIMEOUT_SEC", 12)
+	return time.Second * time.Duration(timeoutsec)
+}
+
 func MaxInflightDNSQueries() int64 {
 	return intenv("MAX_INFLIGHT_DNS_QUERIES", 512)
 }
 
-func UpstreamDoh() string {
-	return strenv("UPSTREAM_DOH", "https://dns.google/dns-query")
+// DNSBlocklist is the path to a file of names, one per line, queries
+// for which (or their subdomains) are answered NXDOMAIN
+func DNSBlocklist() string {
+	return strenv("DNS_BLOCKLIST", "")
+}
+
+// DNSRewrites is the path to a file of "name ip[,ip...]" or "name name"
+// lines, queries for which (or their subdomains) are answered with the
+// ips, or with a CNAME to the name
+func DNSRewrites() string {
+	return strenv("DNS_REWRITES", "")
+}
+
+// DNSCacheSize caps the answers the stub resolver caches; 0 for none
+func DNSCacheSize() int64 {
+	return intenv("DNS_CACHE_SIZE", 4096)
+}
+
+// UpstreamDoh are the urls of upstream resolvers, comma-separated; of
+// DoH (https://), DoT (tls://), or dns over udp:// or tcp:// resolvers
+func UpstreamDoh() []string {
+	var urls []string
+	for _, u := range strings.Split(strenv("UPSTREAM_DOH", "https://dns.google/dns-query"), ",") {
+		if u = strings.TrimSpace(u); len(u) > 0 {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// UpstreamStrategy picks among upstreams; one of "failover" (in order),
+// "rr" (round-robin), "fastest" (by latency), or "hedge" (fastest, and
+// if it is slow to answer, the next fastest, too)
+func UpstreamStrategy() string {
+	return strenv("UPSTREAM_STRATEGY", "failover")
+}
+
+// UpstreamHedgeDelay is how long hedged queries wait on an upstream
+// before asking another, too
+func UpstreamHedgeDelay() time.Duration {
+	ms := intenv("UPSTREAM_HEDGE_MS", 100)
+	return time.Millisecond * time.Duration(ms)
 }
 
 func tlsKeyCertPem() ([]byte, []byte) {
@@ -87,6 +150,110 @@ func TlsCerts() (*tls.Certificate, []string) {
 	}
 }
 
+// RelayPolicy is the path to a file with ordered allow / deny
+// rules that are evaluated for every relayed conn; see relay.LoadPolicy
+func RelayPolicy() string {
+	return strenv("RELAY_POLICY", "")
+}
+
+// RelayRoutes is the path to a file that maps hostnames to backends
+// relayed conns are forwarded to; see relay.LoadRoutes
+func RelayRoutes() string {
+	return strenv("RELAY_ROUTES", "")
+}
+
+// RelayResolver is either "doh", to resolve backends over UPSTREAM_DOH,
+// or "system", to resolve them with the system resolver
+func RelayResolver() string {
+	return strenv("RELAY_RESOLVER", "doh")
+}
+
+// SocksUsers are username / password pairs socks5 and http proxy
+// clients must authenticate with; if none, neither proxy is served
+func SocksUsers() map[string]string {
+	// "user1:pass1,user2:pass2"
+	users := make(map[string]string)
+	for _, up := range strings.Split(strenv("SOCKS_USERS", ""), ",") {
+		if u, p, ok := strings.Cut(up, ":"); ok && len(u) > 0 {
+			users[u] = p
+		}
+	}
+	return users
+}
+
+// LimitConnsPerClient caps concurrent conns from a client; 0 for no cap
+func LimitConnsPerClient() int64 {
+	return intenv("LIMIT_CONNS_PER_CLIENT", 0)
+}
+
+// LimitNewConnsPerSec caps the rate of new conns from a client;
+// 0 for no cap
+func LimitNewConnsPerSec() int64 {
+	return intenv("LIMIT_NEW_CONNS_PER_SEC", 0)
+}
+
+// LimitMaxConns caps concurrent conns overall; 0 for no cap
+func LimitMaxConns() int64 {
+	return intenv("LIMIT_MAX_CONNS", 0)
+}
+
+// LimitClientPrefix4 is the prefix len ip4 clients are grouped by
+func LimitClientPrefix4() int64 {
+	return intenv("LIMIT_CLIENT_PREFIX4", 32)
+}
+
+// LimitClientPrefix6 is the prefix len ip6 clients are grouped by
+func LimitClientPrefix6() int64 {
+	return intenv("LIMIT_CLIENT_PREFIX6", 64)
+}
+
+// LimitShed is either "reset" (RST) or "close" (FIN) conns over limits
+func LimitShed() string {
+	return strenv("LIMIT_SHED", "reset")
+}
+
+// ShapeLinkRate caps bytes relayed per sec in each direction across
+// all conns, like "100mbit" or "10mbps"; unlimited if empty
+func ShapeLinkRate() string {
+	return strenv("SHAPE_LINK_RATE", "")
+}
+
+// RelayHTTPL7 is whether http/1.x conns on port 80 are relayed a
+// request at a time, each to the backend for its own Host; and not
+// all to the backend for the Host of the first request
+func RelayHTTPL7() bool {
+	return strenv("RELAY_HTTP_L7", "true") == "true"
+}
+
+// ECHKey is the base64 x25519 private key midway decrypts ech inner
+// hellos with; ech is only detected, not decrypted, if empty
+func ECHKey() string {
+	return strenv("ECH_KEY", "")
+}
+
+// ECHPublicName is the sni of ech outer hellos, and so the name clients
+// reach midway by; defaults to the fly app's name
+func ECHPublicName() string {
+	if app := FlyAppName(); len(app) > 0 {
+		return strenv("ECH_PUBLIC_NAME", app+".fly.dev")
+	}
+	return strenv("ECH_PUBLIC_NAME", "")
+}
+
+// ECHDomains are the domains (and their subdomains) whose HTTPS records
+// the DoH stub adds midway's ECHConfigList to. Their backends must
+// support ech (as split mode's backend server), or clients treat ech
+// as rejected.
+func ECHDomains() []string {
+	var d []string
+	for _, s := range strings.Split(strenv("ECH_DOMAINS", ""), ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			d = append(d, s)
+		}
+	}
+	return d
+}
+
 func FlyAppName() string {
 	return strenv("FLY_APP_NAME", "")
 }
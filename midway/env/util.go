@@ -6,10 +6,13 @@
 package env
 
 import (
+	"bufio"
 	"crypto/tls"
 	"crypto/x509"
 	"log"
+	"os"
 	"os/user"
+	"strings"
 )
 
 func TlsConfig() *tls.Config {
@@ -48,7 +51,7 @@ func sni(cx *tls.Certificate) []string {
 // ref: stackoverflow.com/a/66624820
 func Sudo() bool {
 	if u, err := user.Current(); err != nil {
-		log.Print("Unable to get cur-user: %s", err)
+		log.Print("Unable to get cur-user: ", err)
 		return false
 	} else {
 		return u.Username == "root"
@@ -64,3 +67,31 @@ func TotalUdpServerRoutines() int {
 	// runtime.NumCPU() instead?
 	return 4
 }
+
+// ConfLine is a line in a config file, like the relay policy, routes,
+// or dns blocklist and rewrites
+type ConfLine struct {
+	N    int      // line number
+	Raw  string   // trimmed line
+	Toks []string // whitespace separated fields
+}
+
+// ReadConf returns non-empty, non-comment lines in the file at path
+func ReadConf(path string) ([]ConfLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []ConfLine
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		raw := strings.TrimSpace(sc.Text())
+		if len(raw) <= 0 || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		out = append(out, ConfLine{N: n, Raw: raw, Toks: strings.Fields(raw)})
+	}
+	return out, sc.Err()
+}
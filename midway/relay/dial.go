@@ -0,0 +1,313 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Resolver resolves hostnames of backends to ip addrs;
+// net.Resolver is one such.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+var (
+	errNoIPs         = errors.New("relay: no ips")
+	errDisallowedIPs = errors.New("relay: no allowed ips")
+
+	resolver Resolver = net.DefaultResolver
+)
+
+// UseResolver sets the resolver backends are looked up with, which
+// otherwise is the system resolver. Must be called before serving conns.
+func UseResolver(r Resolver) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	resolver = r
+}
+
+// rfc8305 section 8
+const (
+	resolutionDelay = 50 * time.Millisecond
+	attemptDelay    = 250 * time.Millisecond
+)
+
+// dialHostPort resolves hostport and races its ips as per Happy
+// Eyeballs v2 (rfc8305), until one connects. Unless trusted, ips that
+// relay must not route to are discarded before any of them is dialled.
+func dialHostPort(typ, hostport string, trusted bool) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), conntimeout)
+	defer cancel()
+
+	return dialContext(ctx, nil, typ, hostport, trusted)
+}
+
+// dialContext is dialHostPort bound by ctx, with conns to resolved ips
+// made by via, or directly if via is nil. Trusted hostports are sent to
+// via as-is, for the proxy to resolve where it egresses; as ips that
+// midway resolves may be of no use there (geo-dns answers, say), or
+// names may not resolve here at all.
+func dialContext(ctx context.Context, via dialFunc, typ, hostport string, trusted bool) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if via != nil && trusted {
+		return viaBackend(via)(ctx, typ, hostport)
+	}
+
+	ips, err := lookupHE(ctx, ipnet(typ), host)
+	if err != nil {
+		return nil, err
+	}
+	if !trusted {
+		ips = allowedIPs(ips)
+		if len(ips) <= 0 {
+			return nil, fmt.Errorf("%w: %s", errDisallowedIPs, host)
+		}
+	}
+
+	if via == nil {
+		via = (&net.Dialer{}).DialContext
+	} else {
+		via = viaBackend(via)
+	}
+	return raceDial(ctx, via, typ, interleave(ips), port)
+}
+
+// viaBackend wraps conns dial makes in a Conn to the backend at the addr
+// dialed, and not to the proxy dial tunnels through
+func viaBackend(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		if wc, ok := c.(*Conn); ok {
+			wc.HostName, wc.Port = host, port
+			return wc, nil
+		}
+		return &Conn{HostName: host, Port: port, Conn: c}, nil
+	}
+}
+
+// lookupHE resolves ip6 and ip4 addrs of host in parallel; if the ip4
+// answer arrives first with addrs, it waits for ip6 only for
+// resolutionDelay; and otherwise for as long as ctx lets it (rfc8305 3).
+func lookupHE(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if _, err := netip.ParseAddr(host); err == nil || network != "ip" {
+		return lookup(ctx, network, host)
+	}
+
+	type ans struct {
+		ips []netip.Addr
+		err error
+		v6  bool
+	}
+	ch := make(chan ans, 2)
+	for _, nw := range []string{"ip6", "ip4"} {
+		go func(nw string) {
+			ips, err := lookup(ctx, nw, host)
+			ch <- ans{ips, err, nw == "ip6"}
+		}(nw)
+	}
+
+	first := <-ch
+	var second ans
+	if first.v6 || len(first.ips) <= 0 {
+		select {
+		case second = <-ch:
+		case <-ctx.Done():
+			second.err = ctx.Err()
+		}
+	} else {
+		t := time.NewTimer(resolutionDelay)
+		select {
+		case second = <-ch:
+		case <-t.C:
+			second.err = fmt.Errorf("%w: ip6 too slow for %s", errNoIPs, host)
+		}
+		t.Stop()
+	}
+
+	ips := append(first.ips, second.ips...)
+	if len(ips) <= 0 {
+		if first.err != nil {
+			return nil, first.err
+		}
+		return nil, second.err
+	}
+	return ips, nil
+}
+
+// interleave orders ips by alternating address families,
+// starting with ip6; as recommended by rfc8305 section 4.
+func interleave(ips []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	out := make([]netip.Addr, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// raceDial starts a conn attempt to the next ip every attemptDelay
+// (or as soon as the previous attempt fails); the first to connect
+// wins, and the others are cancelled.
+func raceDial(ctx context.Context, dial dialFunc, typ string, ips []netip.Addr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialres, len(ips))
+	next, inflight := 0, 0
+	start := func() {
+		ipport := net.JoinHostPort(ips[next].String(), port)
+		next, inflight = next+1, inflight+1
+		go func() {
+			c, err := dial(ctx, typ, ipport)
+			results <- dialres{c, err}
+		}()
+	}
+
+	t := time.NewTimer(attemptDelay)
+	defer t.Stop()
+
+	var errs []string
+	start()
+	for inflight > 0 {
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				go discard(results, inflight)
+				return r.c, nil
+			}
+			errs = append(errs, r.err.Error())
+			if next < len(ips) {
+				start()
+				reset(t, attemptDelay)
+			}
+		case <-t.C:
+			if next < len(ips) {
+				start()
+				t.Reset(attemptDelay)
+			}
+		}
+	}
+	return nil, fmt.Errorf("relay: dial %v:%s: %s", ips, port, strings.Join(errs, "; "))
+}
+
+type dialres struct {
+	c   net.Conn
+	err error
+}
+
+// discard closes conns of the n attempts that lost the race
+func discard(ch chan dialres, n int) {
+	for i := 0; i < n; i++ {
+		if r := <-ch; r.c != nil {
+			r.c.Close()
+		}
+	}
+}
+
+func reset(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// family is "ip4" or "ip6" depending on the backend c is to: its remote
+// addr; or, for conns via proxies, the addr the proxy connected to
+func family(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if wc, ok := c.(*Conn); ok && len(wc.HostName) > 0 {
+		addr = net.JoinHostPort(wc.HostName, wc.Port)
+	}
+	if ipport, err := netip.ParseAddrPort(addr); err == nil && ipport.Addr().Unmap().Is4() {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// lookup resolves host to its ip addrs; ip literals are returned as-is
+func lookup(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	ips, err := resolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) <= 0 {
+		return nil, fmt.Errorf("%w: %s", errNoIPs, host)
+	}
+	for i := range ips {
+		ips[i] = ips[i].Unmap()
+	}
+	return ips, nil
+}
+
+// allowedIPs filters out ips that relay must not route to
+func allowedIPs(ips []netip.Addr) []netip.Addr {
+	out := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if allowedIP(ip) {
+			out = append(out, ip)
+		} else {
+			log.Print("relay: discard lo/mc/priv/invalid/unspecified ip: ", ip)
+		}
+	}
+	return out
+}
+
+func allowedIP(ipaddr netip.Addr) bool {
+	return ipaddr.IsValid() &&
+		!ipaddr.IsPrivate() &&
+		!ipaddr.IsUnspecified() &&
+		!ipaddr.IsLoopback() &&
+		!ipaddr.IsMulticast() &&
+		!ipaddr.IsLinkLocalUnicast() &&
+		!ipaddr.IsLinkLocalMulticast()
+}
+
+// ipnet is the network to resolve for the dial network typ
+func ipnet(typ string) string {
+	switch typ {
+	case "tcp4":
+		return "ip4"
+	case "tcp6":
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// streams are conns being forwarded
+var streams = &inflight{
+	m:    make(map[*Conn]func()),
+	quit: make(chan struct{}),
+}
+
+type inflight struct {
+	mu       sync.Mutex
+	m        map[*Conn]func() // conns, and what else to do to cut them
+	wg       sync.WaitGroup
+	draining bool
+	quit     chan struct{} // closed once draining
+}
+
+// add tracks c, unless draining, in which case it returns false
+func (s *inflight) add(c *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.m[c] = nil
+	s.wg.Add(1)
+	return true
+}
+
+// onCut has fn called, besides c being closed, if c is cut by drain
+func (s *inflight) onCut(c *Conn, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.m[c]; ok {
+		s.m[c] = fn
+	}
+}
+
+// quitting tells whether conns are being drained
+func (s *inflight) quitting() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *inflight) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.m, c)
+	s.wg.Done()
+}
+
+// tarpit waits for d, or until draining, whichever is sooner
+func (s *inflight) tarpit(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.quit:
+	}
+}
+
+// Drain stops conns from being forwarded any further, and waits for the
+// ones in-flight to finish until ctx is done, after which those left
+// are closed. It returns the count of in-flight conns and of those cut.
+func Drain(ctx context.Context) (total, cut int) {
+	return streams.drain(ctx)
+}
+
+func (s *inflight) drain(ctx context.Context) (total, cut int) {
+	s.mu.Lock()
+	if !s.draining {
+		s.draining = true
+		close(s.quit)
+	}
+	total = len(s.m)
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return total, 0
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	for c, fn := range s.m {
+		c.Close()
+		if fn != nil {
+			fn()
+		}
+		cut++
+	}
+	s.mu.Unlock()
+
+	// closed conns unblock their pipes soon enough
+	t := time.NewTimer(time.Second)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+	}
+	return total, cut
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/celzero/gateway/midway/env"
+)
+
+// draft-ietf-tls-esni-22
+const (
+	echVersion      = 0xfe0d
+	echTypeOuter    = 0x00
+	echTypeInner    = 0x01
+	extECHOuterExts = 0xfd00 // ech_outer_extensions
+
+	maxRecord = 16 << 10
+)
+
+var (
+	errECH = errors.New("ech: cannot accept")
+	errHRR = errors.New("ech: backend sent a HelloRetryRequest")
+)
+
+// helloRetryRandom is the random of ServerHellos that are in fact
+// HelloRetryRequests; rfc8446 4.1.3
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// alertHandshakeFailure is a fatal handshake_failure alert record
+var alertHandshakeFailure = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}
+
+// echkey, if set, is the key midway decrypts inner hellos with, as the
+// client-facing server in ech's split mode
+var echkey = mustECHKey(env.ECHKey(), env.ECHPublicName())
+
+// ECHExt is the encrypted_client_hello extension of an outer hello
+type ECHExt struct {
+	KDF      uint16
+	AEAD     uint16
+	ConfigID uint8
+
+	enc        []byte
+	payloadAt  int // offset of the payload in the hello msg
+	payloadLen int
+}
+
+type echKey struct {
+	sk, pk []byte
+	id     uint8
+	config []byte // ECHConfig
+	list   []byte // ECHConfigList, of just the one config
+}
+
+func mustECHKey(b64, publicname string) *echKey {
+	if len(b64) <= 0 {
+		return nil
+	}
+	k, err := newECHKey(b64, publicname)
+	if err != nil {
+		log.Print("ech: disabled; ", err)
+		return nil
+	}
+	log.Printf("ech: client-facing server for %s; config id %d", publicname, k.id)
+	return k
+}
+
+// newECHKey creates an ECHConfig for the base64 x25519 private key b64
+// and the outer hello's sni, publicname.
+func newECHKey(b64, publicname string) (*echKey, error) {
+	sk, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(sk) != 32 {
+		return nil, fmt.Errorf("%w: want a base64 32 byte x25519 key", errECH)
+	}
+	if len(publicname) <= 0 || len(publicname) > 255 {
+		return nil, fmt.Errorf("%w: want a public name", errECH)
+	}
+	pk, err := x25519Public(sk)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(pk)
+	k := &echKey{sk: sk, pk: pk, id: sum[0]}
+
+	// ECHConfigContents
+	var c []byte
+	c = append(c, k.id)
+	c = append16(c, hpkeKemX25519)
+	c = appendVec(c, 2, pk)
+	suites := []uint16{hpkeKdfSha256, hpkeAeadAes128, hpkeKdfSha256, hpkeAeadChacha20}
+	c = append16(c, uint16(len(suites)*2))
+	for _, x := range suites {
+		c = append16(c, x)
+	}
+	c = append(c, 0) // maximum_name_length; unknown
+	c = appendVec(c, 1, []byte(publicname))
+	c = append16(c, 0) // no extensions
+
+	k.config = appendVec(append16(nil, echVersion), 2, c)
+	k.list = appendVec(nil, 2, k.config)
+	return k, nil
+}
+
+// ECHConfigList is the ECHConfigList for clients to encrypt hellos to
+// midway with; or nil if midway has no ech key.
+func ECHConfigList() []byte {
+	if echkey == nil {
+		return nil
+	}
+	return echkey.list
+}
+
+// unwrapECH decrypts the inner hello of outer, the hello in br; and
+// returns it, along with the records it's sent in, which are to stand
+// in for the first n bytes in br, the records of the outer hello.
+func unwrapECH(br *bufio.Reader, outer *ClientHello) (inner *ClientHello, recs []byte, n int, err error) {
+	k := echkey
+	e := outer.ECH
+	if k == nil {
+		return nil, nil, 0, fmt.Errorf("%w: no key", errECH)
+	} else if e == nil {
+		return nil, nil, 0, fmt.Errorf("%w: not ech", errECH)
+	} else if e.ConfigID != k.id {
+		return nil, nil, 0, fmt.Errorf("%w: unknown config id %d", errECH, e.ConfigID)
+	}
+
+	msg, n, err := peekHandshake(br)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	hdr, err := br.Peek(3)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// ClientHelloOuterAAD is the outer hello sans its handshake header,
+	// with the payload zeroed out
+	aad := append([]byte{}, msg[4:]...)
+	payload := msg[e.payloadAt : e.payloadAt+e.payloadLen]
+	for i := e.payloadAt - 4; i < e.payloadAt-4+e.payloadLen; i++ {
+		aad[i] = 0
+	}
+	info := append([]byte("tls ech\x00"), k.config...)
+
+	encoded, err := hpkeOpen(e.KDF, e.AEAD, k.sk, k.pk, e.enc, info, aad, payload)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	innermsg, err := decodeInner(encoded, msg)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if inner, err = parseClientHello(innermsg); err != nil {
+		return nil, nil, 0, err
+	} else if !inner.echInner {
+		return nil, nil, 0, fmt.Errorf("%w: inner hello sans ech", errECH)
+	}
+	return inner, records(hdr[1], hdr[2], innermsg), n, nil
+}
+
+// sendInner sends the inner hello (and all else) in src.Peeked to dst,
+// and peeks at the handshake msg dst replies with; which mustn't be a
+// HelloRetryRequest, as midway keeps no hpke context to open the second
+// inner hello with (draft-ietf-tls-esni 6.1.5). It returns dst, covering
+// for the bytes peeked.
+func sendInner(src *Conn, dst net.Conn) (net.Conn, error) {
+	if _, err := dst.Write(src.Peeked); err != nil {
+		return nil, err
+	}
+	src.Peeked = nil
+
+	br := bufio.NewReaderSize(dst, 5+maxRecord)
+	_ = dst.SetReadDeadline(time.Now().Add(conntimeout))
+	msg, _, err := peekHandshake(br)
+	_ = dst.SetReadDeadline(time.Time{})
+	if err == nil && isHelloRetry(msg) {
+		return nil, errHRR
+	}
+	// else, whatever dst sent (even if not a ServerHello) is for src
+	peeked, _ := br.Peek(br.Buffered())
+	if wc, ok := dst.(*Conn); ok {
+		wc.Peeked = append(peeked, wc.Peeked...)
+		return wc, nil
+	}
+	return &Conn{Peeked: peeked, Conn: dst}, nil
+}
+
+// isHelloRetry tells whether handshake msg is a HelloRetryRequest
+func isHelloRetry(msg []byte) bool {
+	const typeServerHello = 0x02
+	// type (1), len (3), legacy_version (2), random (32)
+	return len(msg) >= 4+2+32 && msg[0] == typeServerHello && bytes.Equal(msg[6:38], helloRetryRandom)
+}
+
+// decodeInner reconstructs the inner hello (a handshake msg) from
+// EncodedClientHelloInner b, and the outer hello (also a msg).
+func decodeInner(b, outermsg []byte) ([]byte, error) {
+	sid, outerexts, err := outerParts(outermsg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := helloReader(b)
+	var head, isid, suites, comp, exts helloReader
+	var ok bool
+	head = s
+	if !s.skip(2+32) || !readVec(&s, 1, &isid) || len(isid) != 0 {
+		return nil, fmt.Errorf("%w: bad inner session id", errECH)
+	}
+	if !readVec(&s, 2, &suites) || !readVec(&s, 1, &comp) {
+		return nil, fmt.Errorf("%w: bad inner hello", errECH)
+	}
+	if exts, ok = s.vec(2); !ok {
+		return nil, fmt.Errorf("%w: bad inner extensions", errECH)
+	}
+	for _, pad := range s {
+		if pad != 0 {
+			return nil, fmt.Errorf("%w: bad inner padding", errECH)
+		}
+	}
+
+	var body []byte
+	body = append(body, head[:2+32]...)
+	body = appendVec(body, 1, sid)
+	body = appendVec(body, 2, suites)
+	body = appendVec(body, 1, comp)
+
+	var all []byte
+	for len(exts) > 0 {
+		raw := exts
+		typ, ok1 := exts.u16()
+		data, ok2 := exts.vec(2)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: bad inner extension", errECH)
+		}
+		if typ != extECHOuterExts {
+			all = append(all, raw[:4+len(data)]...)
+			continue
+		}
+		// copy over the referenced outer extensions, in order
+		var refs helloReader
+		if refs, ok = data.vec(1); !ok || len(refs)%2 != 0 {
+			return nil, fmt.Errorf("%w: bad outer extensions", errECH)
+		}
+		for len(refs) > 0 {
+			ref, _ := refs.u16()
+			ext, ok := outerexts[ref]
+			if !ok || ref == extECH {
+				return nil, fmt.Errorf("%w: bad outer extension %d", errECH, ref)
+			}
+			all = append(all, ext...)
+		}
+	}
+	body = appendVec(body, 2, all)
+
+	if len(body) > maxHello {
+		return nil, fmt.Errorf("%w: inner hello too large", errECH)
+	}
+	msg := []byte{typeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...), nil
+}
+
+// outerParts returns the session id and the raw extensions, by type,
+// of hello msg, which must parse.
+func outerParts(msg []byte) (sid []byte, exts map[uint16][]byte, err error) {
+	s := helloReader(msg)
+	var suites, comp, all helloReader
+	if !s.skip(4+2+32) || !readVec(&s, 1, (*helloReader)(&sid)) ||
+		!readVec(&s, 2, &suites) || !readVec(&s, 1, &comp) || !readVec(&s, 2, &all) {
+		return nil, nil, fmt.Errorf("%w: bad outer hello", errECH)
+	}
+	exts = make(map[uint16][]byte)
+	for len(all) > 0 {
+		raw := all
+		typ, ok1 := all.u16()
+		data, ok2 := all.vec(2)
+		if !ok1 || !ok2 {
+			return nil, nil, fmt.Errorf("%w: bad outer extension", errECH)
+		}
+		if _, dup := exts[typ]; !dup {
+			exts[typ] = raw[:4+len(data)]
+		}
+	}
+	return sid, exts, nil
+}
+
+// records frames handshake msg into tls records of version v0.v1
+func records(v0, v1 byte, msg []byte) []byte {
+	var out []byte
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > maxRecord {
+			n = maxRecord
+		}
+		out = append(out, 0x16, v0, v1, byte(n>>8), byte(n))
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+func readVec(s *helloReader, lenlen int, v *helloReader) (ok bool) {
+	*v, ok = s.vec(lenlen)
+	return
+}
+
+func append16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendVec appends v to b prefixed with its length in lenlen bytes
+func appendVec(b []byte, lenlen int, v []byte) []byte {
+	for i := lenlen - 1; i >= 0; i-- {
+		b = append(b, byte(len(v)>>(8*i)))
+	}
+	return append(b, v...)
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	echPublic = "public.example"
+	echSecret = "secret.example"
+)
+
+func ext(typ uint16, data []byte) []byte {
+	return appendVec(append16(nil, typ), 2, data)
+}
+
+func sniExt(name string) []byte {
+	return ext(extServerName, appendVec(nil, 2, appendVec([]byte{0}, 2, []byte(name))))
+}
+
+func outerExtsExt(typs ...uint16) []byte {
+	var refs []byte
+	for _, t := range typs {
+		refs = append16(refs, t)
+	}
+	return ext(extECHOuterExts, appendVec(nil, 1, refs))
+}
+
+// helloBody is a ClientHello sans its handshake header
+func helloBody(random, sid, exts []byte) []byte {
+	b := append16(nil, 0x0303)
+	b = append(b, random...)
+	b = appendVec(b, 1, sid)
+	b = appendVec(b, 2, []byte{0x13, 0x01, 0x13, 0x02})
+	b = appendVec(b, 1, []byte{0})
+	return appendVec(b, 2, exts)
+}
+
+// echTest is the stuff of an outer hello that encrypts an inner one
+type echTest struct {
+	inner  []byte // EncodedClientHelloInner
+	badID  bool   // sends a config id other than the key's
+	tamper bool   // flips a bit of the payload
+}
+
+// encodedInner is an EncodedClientHelloInner (with padding pad) of
+// exts, which are preceded by the sni of echSecret
+func encodedInner(sid []byte, pad []byte, exts ...[]byte) []byte {
+	all := sniExt(echSecret)
+	for _, e := range exts {
+		all = append(all, e...)
+	}
+	return append(helloBody(bytes.Repeat([]byte{7}, 32), sid, all), pad...)
+}
+
+// sealOuter returns the records of an outer hello to k, whose payload
+// is tc.inner sealed as a client would
+func sealOuter(t *testing.T, k *echKey, tc echTest) []byte {
+	t.Helper()
+	skE := make([]byte, 32)
+	if _, err := rand.Read(skE); err != nil {
+		t.Fatal(err)
+	}
+	enc, _ := x25519Public(skE)
+	dh, err := curve25519.X25519(skE, k.pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := append([]byte("tls ech\x00"), k.config...)
+	key, nonce, err := hpkeKeys(hpkeKdfSha256, hpkeAeadAes128, dh, enc, k.pk, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := hpkeAEAD(hpkeAeadAes128, key)
+
+	id := k.id
+	if tc.badID {
+		id++
+	}
+	payloadLen := len(tc.inner) + a.Overhead()
+	ech := []byte{echTypeOuter}
+	ech = append16(ech, hpkeKdfSha256)
+	ech = append16(ech, hpkeAeadAes128)
+	ech = append(ech, id)
+	ech = appendVec(ech, 2, enc)
+	ech = appendVec(ech, 2, make([]byte, payloadLen))
+
+	var exts []byte
+	exts = append(exts, sniExt(echPublic)...)
+	exts = append(exts, ext(extKeyShare, appendVec(nil, 2, appendVec(append16(nil, 0x001d), 2, make([]byte, 32))))...)
+	exts = append(exts, ext(extSupportedVersions, appendVec(nil, 1, []byte{0x03, 0x04, 0x03, 0x03}))...)
+	exts = append(exts, ext(extSignatureAlgorithms, appendVec(nil, 2, []byte{0x08, 0x04}))...)
+	// the payload is last in the ech ext, and so, in the hello
+	exts = append(exts, ext(extECH, ech)...)
+
+	body := helloBody(bytes.Repeat([]byte{9}, 32), bytes.Repeat([]byte{3}, 32), exts)
+	msg := append([]byte{typeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+
+	// the aad is the outer hello with the payload zeroed, as it is now
+	ct := a.Seal(nil, nonce, tc.inner, msg[4:])
+	if tc.tamper {
+		ct[len(ct)/2] ^= 1
+	}
+	copy(msg[len(msg)-payloadLen:], ct)
+	return fragment(msg, len(msg)/2)
+}
+
+// withECHKey sets echkey to a new key for the test's duration
+func withECHKey(t *testing.T) *echKey {
+	t.Helper()
+	sk := make([]byte, 32)
+	if _, err := rand.Read(sk); err != nil {
+		t.Fatal(err)
+	}
+	k, err := newECHKey(base64.StdEncoding.EncodeToString(sk), echPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := echkey
+	echkey = k
+	t.Cleanup(func() { echkey = prev })
+	return k
+}
+
+func TestUnwrapECH(t *testing.T) {
+	k := withECHKey(t)
+	echInner := ext(extECH, []byte{echTypeInner})
+	alpn := ext(extALPN, appendVec(nil, 2, appendVec(nil, 1, []byte("h2"))))
+	ok := encodedInner(nil, make([]byte, 12), echInner, alpn, outerExtsExt(extKeyShare, extSupportedVersions))
+
+	tests := []struct {
+		name string
+		tc   echTest
+		err  error
+	}{
+		{name: "ok", tc: echTest{inner: ok}},
+		{name: "sans padding", tc: echTest{inner: encodedInner(nil, nil, echInner, outerExtsExt(extKeyShare))}},
+		{name: "sans outer extensions", tc: echTest{inner: encodedInner(nil, nil, echInner, alpn)}},
+		{name: "tampered payload", tc: echTest{inner: ok, tamper: true}, err: errHpke},
+		{name: "unknown config id", tc: echTest{inner: ok, badID: true}, err: errECH},
+		{name: "truncated inner", tc: echTest{inner: ok[:len(ok)-12-5]}, err: errECH},
+		{name: "truncated inner head", tc: echTest{inner: ok[:20]}, err: errECH},
+		{name: "nonzero padding", tc: echTest{inner: append(append([]byte{}, ok...), 1)}, err: errECH},
+		{name: "inner with a session id", tc: echTest{inner: encodedInner([]byte{1}, nil, echInner)}, err: errECH},
+		{name: "inner sans ech", tc: echTest{inner: encodedInner(nil, nil, alpn)}, err: errECH},
+		{
+			name: "outer extension missing",
+			tc:   echTest{inner: encodedInner(nil, nil, echInner, outerExtsExt(extALPN))},
+			err:  errECH,
+		},
+		{
+			name: "outer extension is ech",
+			tc:   echTest{inner: encodedInner(nil, nil, echInner, outerExtsExt(extECH))},
+			err:  errECH,
+		},
+		{
+			name: "odd outer extensions",
+			tc:   echTest{inner: encodedInner(nil, nil, echInner, ext(extECHOuterExts, []byte{3, 0, 0x33, 0}))},
+			err:  errECH,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			in := sealOuter(t, k, tc.tc)
+			br := bufio.NewReaderSize(bytes.NewReader(in), helloBufSize)
+			outer := readClientHello(br)
+			if outer == nil || outer.ECH == nil || outer.ServerName != echPublic {
+				t.Fatalf("bad outer hello %+v", outer)
+			}
+
+			inner, recs, n, err := unwrapECH(br, outer)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("want err %v; got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(in) {
+				t.Fatalf("want outer records of %d bytes; got %d", len(in), n)
+			}
+			if inner.ServerName != echSecret || !inner.echInner {
+				t.Fatalf("want inner hello to %s; got %q", echSecret, inner.ServerName)
+			}
+			// the records parse to the inner hello
+			again := readClientHello(bufio.NewReaderSize(bytes.NewReader(recs), helloBufSize))
+			if again == nil || again.ServerName != echSecret {
+				t.Fatalf("records sans the inner hello; got %+v", again)
+			}
+			// the session id is the outer hello's
+			msg, _, _ := peekHandshake(bufio.NewReaderSize(bytes.NewReader(recs), helloBufSize))
+			if sid := msg[4+2+32+1 : 4+2+32+1+32]; msg[4+2+32] != 32 || !bytes.Equal(sid, bytes.Repeat([]byte{3}, 32)) {
+				t.Fatalf("want the outer session id; got %x", sid)
+			}
+		})
+	}
+}
+
+func TestUnwrapECHOuterExtensions(t *testing.T) {
+	k := withECHKey(t)
+	echInner := ext(extECH, []byte{echTypeInner})
+	inner := encodedInner(nil, nil, echInner, outerExtsExt(extKeyShare, extSupportedVersions, extSignatureAlgorithms))
+
+	in := sealOuter(t, k, echTest{inner: inner})
+	br := bufio.NewReaderSize(bytes.NewReader(in), helloBufSize)
+	outer := readClientHello(br)
+	h, _, _, err := unwrapECH(br, outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// expanded in place, and in the order referenced
+	want := []uint16{extServerName, extECH, extKeyShare, extSupportedVersions, extSignatureAlgorithms}
+	if len(h.Extensions) != len(want) {
+		t.Fatalf("want exts %x; got %x", want, h.Extensions)
+	}
+	for i := range want {
+		if h.Extensions[i] != want[i] {
+			t.Fatalf("want exts %x; got %x", want, h.Extensions)
+		}
+	}
+	if len(h.KeyShares) != 1 || h.KeyShares[0] != 0x001d || len(h.SupportedVersions) != 2 || h.SupportedVersions[0] != 0x0304 {
+		t.Fatalf("outer exts not copied; shares %x vers %x", h.KeyShares, h.SupportedVersions)
+	}
+}
+
+func TestSendInner(t *testing.T) {
+	serverHello := func(random []byte) []byte {
+		body := append16(nil, 0x0303)
+		body = append(body, random...)
+		body = append(body, 0, 0x13, 0x01, 0) // sid, suite, comp
+		msg := append([]byte{0x02, 0, 0, byte(len(body))}, body...)
+		return fragment(msg)
+	}
+	hello := serverHello(bytes.Repeat([]byte{5}, 32))
+	hrr := serverHello(helloRetryRandom)
+	alert := record(recordTypeAlert, []byte{2, 40})
+
+	tests := []struct {
+		name  string
+		reply []byte
+		err   error
+	}{
+		{name: "server hello", reply: hello},
+		{name: "alert", reply: alert},
+		{name: "hello retry request", reply: hrr, err: errHRR},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, backend := net.Pipe()
+			defer c.Close()
+			go func() {
+				defer backend.Close()
+				got := make([]byte, 5)
+				if _, err := io.ReadFull(backend, got); err != nil || string(got) != "inner" {
+					return
+				}
+				_, _ = backend.Write(append(tc.reply, "more"...))
+			}()
+
+			src := &Conn{Peeked: []byte("inner")}
+			dst, err := sendInner(src, c)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("want err %v; got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(src.Peeked) != 0 {
+				t.Fatal("src.Peeked not sent")
+			}
+			// dst's reply is relayed as-is
+			_ = dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+			want := append(append([]byte{}, tc.reply...), "more"...)
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(dst, got); err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("want %x; got %x (err %v)", want, got, err)
+			}
+		})
+	}
+}
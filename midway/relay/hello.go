@@ -0,0 +1,540 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tls extensions, rfc8446 4.2 and iana.org/assignments/tls-extensiontype-values
+const (
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+	extKeyShare            = 0x0033
+	extECH                 = 0xfe0d // draft-ietf-tls-esni
+
+	typeClientHello = 0x01
+)
+
+var errBadHello = errors.New("relay: bad client hello")
+
+// ClientHello is a tls ClientHello, as sent by the client. Lists are in
+// the order the client sent them in, and include GREASE values, if any.
+// Lists of uint16s are all carved out of a single allocation, as hellos
+// are parsed for every conn to port 443 and 853.
+type ClientHello struct {
+	Version             uint16 // legacy_version
+	ServerName          string
+	ALPN                []string
+	SupportedVersions   []uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+	KeyShares           []uint16 // groups of key shares sent
+	// ECH is the encrypted_client_hello ext of outer hellos; or nil
+	ECH *ECHExt
+
+	echInner bool     // has an encrypted_client_hello ext of type inner
+	arena    []uint16 // backs all []uint16s above
+	ja3, ja4 string
+}
+
+// maxHello caps the size of ClientHellos, which are sniffed with a
+// bufio.Reader of helloBufSize, big enough for a hello fragmented into
+// a fair few records.
+const (
+	maxHello     = 16 << 10
+	helloBufSize = maxHello + 4<<10
+)
+
+// readClientHello parses the ClientHello in br, without consuming any
+// bytes from br; or returns nil. It replaces a tls.Server handshake on
+// the peeked bytes, which cost an order of magnitude more.
+func readClientHello(br *bufio.Reader) *ClientHello {
+	msg, _, err := peekHandshake(br)
+	if err != nil {
+		return nil
+	}
+	h, err := parseClientHello(msg)
+	if err != nil {
+		return nil
+	}
+	return h
+}
+
+// peekHandshake reassembles the first handshake message in br from
+// as many tls records as it is fragmented into, without consuming any
+// bytes from br. It returns the message, and the bytes its records span.
+func peekHandshake(br *bufio.Reader) (msg []byte, n int, err error) {
+	const recordHeaderLen = 5
+	const recordTypeHandshake = 0x16
+	want := -1 // len of msg, once known
+	for want < 0 || len(msg) < want {
+		if n+recordHeaderLen > br.Size() {
+			return nil, 0, fmt.Errorf("%w: too many records", errBadHello)
+		}
+		hdr, err := br.Peek(n + recordHeaderLen)
+		if err != nil {
+			return nil, 0, err
+		}
+		hdr = hdr[n:]
+		if hdr[0] != recordTypeHandshake {
+			return nil, 0, fmt.Errorf("%w: record type %d", errBadHello, hdr[0])
+		}
+		recLen := int(hdr[3])<<8 | int(hdr[4]) // ignoring version in hdr[1:3]
+		if recLen <= 0 {
+			return nil, 0, fmt.Errorf("%w: empty record", errBadHello)
+		}
+		if n+recordHeaderLen+recLen > br.Size() {
+			return nil, 0, fmt.Errorf("%w: too many records", errBadHello)
+		}
+		rec, err := br.Peek(n + recordHeaderLen + recLen)
+		if err != nil {
+			return nil, 0, err
+		}
+		frag := rec[n+recordHeaderLen:]
+		n += recordHeaderLen + recLen
+
+		if want < 0 && len(msg)+len(frag) >= 4 {
+			// handshake type (1 byte), and length (3 bytes)
+			b := append(msg[:len(msg):len(msg)], frag[:4-len(msg)]...)
+			want = 4 + (int(b[1])<<16 | int(b[2])<<8 | int(b[3]))
+			if want > maxHello {
+				return nil, 0, fmt.Errorf("%w: %d bytes too large", errBadHello, want)
+			}
+			if len(msg) <= 0 && len(frag) >= want {
+				// unfragmented hellos need not be copied
+				return frag[:want], n, nil
+			}
+		}
+		// copied, as peeking further may move bytes about in br
+		msg = append(msg, frag...)
+	}
+	// records may carry other messages after the hello
+	return msg[:want], n, nil
+}
+
+// parseClientHello parses handshake message msg, which must be a
+// ClientHello; rfc8446 4.1.2. The hello returned doesn't refer to msg.
+func parseClientHello(msg []byte) (*ClientHello, error) {
+	s := helloReader(msg)
+	typ, ok := s.u8()
+	if !ok || typ != typeClientHello {
+		return nil, fmt.Errorf("%w: handshake type %d", errBadHello, typ)
+	}
+	body, ok := s.vec(3)
+	if !ok {
+		return nil, fmt.Errorf("%w: truncated", errBadHello)
+	}
+
+	// no more uint16s than there are pairs of bytes in body
+	h := &ClientHello{arena: make([]uint16, 0, len(body)/2)}
+	s = body
+	var sid, suites, comp helloReader
+	if h.Version, ok = s.u16(); !ok {
+		return nil, fmt.Errorf("%w: no version", errBadHello)
+	}
+	if !s.skip(32) { // random
+		return nil, fmt.Errorf("%w: no random", errBadHello)
+	}
+	if sid, ok = s.vec(1); !ok || len(sid) > 32 {
+		return nil, fmt.Errorf("%w: bad session id", errBadHello)
+	}
+	if suites, ok = s.vec(2); !ok || len(suites)%2 != 0 {
+		return nil, fmt.Errorf("%w: bad cipher suites", errBadHello)
+	}
+	h.CipherSuites = h.u16s(suites)
+	if comp, ok = s.vec(1); !ok || len(comp) < 1 {
+		return nil, fmt.Errorf("%w: bad compression methods", errBadHello)
+	}
+	if len(s) <= 0 {
+		return h, nil // no extensions
+	}
+
+	exts, ok := s.vec(2)
+	if !ok {
+		return nil, fmt.Errorf("%w: bad extensions", errBadHello)
+	}
+	h.Extensions = h.reserve(count(exts, 2, 2))
+	for len(exts) > 0 {
+		typ, ok1 := exts.u16()
+		data, ok2 := exts.vec(2)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: bad extension", errBadHello)
+		}
+		h.Extensions = append(h.Extensions, typ)
+		if err := h.parseExt(msg, typ, data); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// parseExt parses extension typ in data, which is a slice of msg
+func (h *ClientHello) parseExt(msg []byte, typ uint16, data helloReader) error {
+	var ok bool
+	switch typ {
+	case extServerName:
+		var names helloReader
+		if names, ok = data.vec(2); !ok {
+			return fmt.Errorf("%w: bad server name", errBadHello)
+		}
+		for len(names) > 0 {
+			nametyp, ok1 := names.u8()
+			name, ok2 := names.vec(2)
+			if !ok1 || !ok2 {
+				return fmt.Errorf("%w: bad server name", errBadHello)
+			}
+			if nametyp == 0 { // host_name
+				h.ServerName = string(name)
+			}
+		}
+	case extALPN:
+		var protos helloReader
+		if protos, ok = data.vec(2); !ok {
+			return fmt.Errorf("%w: bad alpn", errBadHello)
+		}
+		h.ALPN = make([]string, 0, count(protos, 0, 1))
+		for len(protos) > 0 {
+			p, ok := protos.vec(1)
+			if !ok || len(p) <= 0 {
+				return fmt.Errorf("%w: bad alpn", errBadHello)
+			}
+			h.ALPN = append(h.ALPN, string(p))
+		}
+	case extSupportedVersions:
+		var vers helloReader
+		if vers, ok = data.vec(1); !ok || len(vers)%2 != 0 {
+			return fmt.Errorf("%w: bad supported versions", errBadHello)
+		}
+		h.SupportedVersions = h.u16s(vers)
+	case extSupportedGroups:
+		var groups helloReader
+		if groups, ok = data.vec(2); !ok || len(groups)%2 != 0 {
+			return fmt.Errorf("%w: bad supported groups", errBadHello)
+		}
+		h.SupportedGroups = h.u16s(groups)
+	case extECPointFormats:
+		var fmts helloReader
+		if fmts, ok = data.vec(1); !ok {
+			return fmt.Errorf("%w: bad point formats", errBadHello)
+		}
+		h.ECPointFormats = append([]uint8{}, fmts...)
+	case extSignatureAlgorithms:
+		var algs helloReader
+		if algs, ok = data.vec(2); !ok || len(algs)%2 != 0 {
+			return fmt.Errorf("%w: bad signature algorithms", errBadHello)
+		}
+		h.SignatureAlgorithms = h.u16s(algs)
+	case extKeyShare:
+		var shares helloReader
+		if shares, ok = data.vec(2); !ok {
+			return fmt.Errorf("%w: bad key share", errBadHello)
+		}
+		h.KeyShares = h.reserve(count(shares, 2, 2))
+		for len(shares) > 0 {
+			group, ok1 := shares.u16()
+			_, ok2 := shares.vec(2)
+			if !ok1 || !ok2 {
+				return fmt.Errorf("%w: bad key share", errBadHello)
+			}
+			h.KeyShares = append(h.KeyShares, group)
+		}
+	case extECH:
+		var echtyp uint8
+		if echtyp, ok = data.u8(); !ok {
+			return fmt.Errorf("%w: bad ech", errBadHello)
+		}
+		if echtyp == echTypeInner {
+			h.echInner = true
+			break
+		}
+		e := &ECHExt{}
+		var enc, payload helloReader
+		var ok1, ok2, ok3, ok4, ok5 bool
+		e.KDF, ok1 = data.u16()
+		e.AEAD, ok2 = data.u16()
+		e.ConfigID, ok3 = data.u8()
+		enc, ok4 = data.vec(2)
+		payload, ok5 = data.vec(2)
+		if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || len(payload) <= 0 {
+			return fmt.Errorf("%w: bad ech", errBadHello)
+		}
+		e.enc = append([]byte{}, enc...)
+		// msg and payload share the same backing array, and so the
+		// difference in their capacities is where payload begins
+		e.payloadAt = cap(msg) - cap(payload)
+		e.payloadLen = len(payload)
+		h.ECH = e
+	}
+	return nil
+}
+
+// MaxVersion is the highest tls version the client supports
+func (h *ClientHello) MaxVersion() uint16 {
+	hi := h.Version
+	for _, v := range h.SupportedVersions {
+		if !isGrease(v) && v > hi {
+			hi = v
+		}
+	}
+	return hi
+}
+
+// JA3 is the md5 of version, ciphers, extensions, groups, and point
+// formats, sans GREASE; see github.com/salesforce/ja3
+func (h *ClientHello) JA3() string {
+	if len(h.ja3) > 0 {
+		return h.ja3
+	}
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(h.Version)))
+	b.WriteByte(',')
+	joinDec(&b, h.CipherSuites)
+	b.WriteByte(',')
+	joinDec(&b, h.Extensions)
+	b.WriteByte(',')
+	joinDec(&b, h.SupportedGroups)
+	b.WriteByte(',')
+	for i, f := range h.ECPointFormats {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(strconv.Itoa(int(f)))
+	}
+	sum := md5.Sum([]byte(b.String()))
+	h.ja3 = hex.EncodeToString(sum[:])
+	return h.ja3
+}
+
+// JA4 is the JA4 fingerprint (like t13d1516h2_8daaf6152771_e5627efa2ab1)
+// of the hello, as sent over tcp; see github.com/FoxIO-LLC/ja4
+func (h *ClientHello) JA4() string {
+	if len(h.ja4) > 0 {
+		return h.ja4
+	}
+
+	var a strings.Builder
+	a.WriteByte('t')
+	a.WriteString(ja4Version(h.MaxVersion()))
+	if len(h.ServerName) > 0 {
+		a.WriteByte('d')
+	} else {
+		a.WriteByte('i')
+	}
+	ciphers := sansGrease(h.CipherSuites)
+	exts := sansGrease(h.Extensions)
+	fmt.Fprintf(&a, "%02d%02d", min99(len(ciphers)), min99(len(exts)))
+	a.WriteString(ja4ALPN(h.ALPN))
+
+	// sni and alpn are already accounted for in part a
+	sorted := make([]uint16, 0, len(exts))
+	for _, e := range exts {
+		if e != extServerName && e != extALPN {
+			sorted = append(sorted, e)
+		}
+	}
+	sortU16(ciphers)
+	sortU16(sorted)
+	c := joinHex(sorted)
+	if algs := sansGrease(h.SignatureAlgorithms); len(algs) > 0 {
+		c += "_" + joinHex(algs)
+	}
+
+	h.ja4 = a.String() + "_" + ja4Hash(joinHex(ciphers), len(ciphers)) + "_" + ja4Hash(c, len(sorted))
+	return h.ja4
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+func ja4ALPN(alpn []string) string {
+	if len(alpn) <= 0 || len(alpn[0]) <= 0 {
+		return "00"
+	}
+	p := alpn[0]
+	first, last := p[0], p[len(p)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	x := hex.EncodeToString([]byte(p))
+	return string([]byte{x[0], x[len(x)-1]})
+}
+
+func ja4Hash(s string, n int) string {
+	if n <= 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// isGrease reports whether v is a rfc8701 GREASE value, like 0x0a0a
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func sansGrease(vs []uint16) []uint16 {
+	out := make([]uint16, 0, len(vs))
+	for _, v := range vs {
+		if !isGrease(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDec(b *strings.Builder, vs []uint16) {
+	first := true
+	for _, v := range vs {
+		if isGrease(v) {
+			continue
+		}
+		if !first {
+			b.WriteByte('-')
+		}
+		first = false
+		b.WriteString(strconv.Itoa(int(v)))
+	}
+}
+
+func joinHex(vs []uint16) string {
+	var b strings.Builder
+	for i, v := range vs {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%04x", v)
+	}
+	return b.String()
+}
+
+func sortU16(vs []uint16) {
+	sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+// helloReader reads big-endian ints and length-prefixed vectors off of
+// itself, much like cryptobyte.String
+type helloReader []byte
+
+func (s *helloReader) skip(n int) bool {
+	if len(*s) < n {
+		return false
+	}
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *helloReader) u8() (uint8, bool) {
+	if len(*s) < 1 {
+		return 0, false
+	}
+	v := (*s)[0]
+	*s = (*s)[1:]
+	return v, true
+}
+
+func (s *helloReader) u16() (uint16, bool) {
+	if len(*s) < 2 {
+		return 0, false
+	}
+	v := uint16((*s)[0])<<8 | uint16((*s)[1])
+	*s = (*s)[2:]
+	return v, true
+}
+
+// vec reads a vector prefixed with its length in lenlen bytes
+func (s *helloReader) vec(lenlen int) (helloReader, bool) {
+	if len(*s) < lenlen {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*s)[:lenlen] {
+		n = n<<8 | int(b)
+	}
+	*s = (*s)[lenlen:]
+	if len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+// u16s copies the uint16s in s to h's arena
+func (h *ClientHello) u16s(s helloReader) []uint16 {
+	vs := h.reserve(len(s) / 2)
+	for len(s) >= 2 {
+		v, _ := s.u16()
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+// reserve returns an empty slice with room for n uint16s in h's arena
+func (h *ClientHello) reserve(n int) []uint16 {
+	at := len(h.arena)
+	if at+n > cap(h.arena) {
+		// can't happen, as n is never more than what's left of the
+		// bytes the arena is sized by; but just in case
+		return make([]uint16, 0, n)
+	}
+	h.arena = h.arena[:at+n]
+	return h.arena[at : at : at+n]
+}
+
+// count counts the elements in s, which are each skip bytes followed by
+// a vector with a lenlen bytes long length; or 0, if s is malformed.
+func count(s helloReader, skip, lenlen int) (n int) {
+	for len(s) > 0 {
+		if !s.skip(skip) {
+			return 0
+		}
+		if _, ok := s.vec(lenlen); !ok {
+			return 0
+		}
+		n++
+	}
+	return n
+}
@@ -0,0 +1,379 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+const (
+	recordTypeAlert     = 0x15
+	recordTypeHandshake = 0x16
+)
+
+// helloMsg returns the ClientHello crypto/tls sends for sni, sans its
+// record header
+func helloMsg(tb testing.TB, sni string) []byte {
+	tb.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		cli := tls.Client(c, &tls.Config{ServerName: sni, NextProtos: []string{"h2", "http/1.1"}})
+		_ = cli.Handshake()
+		c.Close()
+	}()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		tb.Fatal(err)
+	}
+	rec := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(s, rec); err != nil {
+		tb.Fatal(err)
+	}
+	return rec
+}
+
+// handshakeMsg is a handshake message of type ClientHello with a body
+// of n zeroes, for tests that need not parse it
+func handshakeMsg(n int) []byte {
+	msg := make([]byte, 4+n)
+	msg[0] = typeClientHello
+	msg[1], msg[2], msg[3] = byte(n>>16), byte(n>>8), byte(n)
+	return msg
+}
+
+// record frames frag as a tls record of type typ
+func record(typ byte, frag []byte) []byte {
+	return append([]byte{typ, 0x03, 0x01, byte(len(frag) >> 8), byte(len(frag))}, frag...)
+}
+
+// fragment fragments msg into handshake records at offsets at
+func fragment(msg []byte, at ...int) []byte {
+	var out []byte
+	prev := 0
+	for _, i := range append(at, len(msg)) {
+		out = append(out, record(recordTypeHandshake, msg[prev:i])...)
+		prev = i
+	}
+	return out
+}
+
+// everyN fragments msg into handshake records of n bytes each
+func everyN(msg []byte, n int) []byte {
+	var at []int
+	for i := n; i < len(msg); i += n {
+		at = append(at, i)
+	}
+	return fragment(msg, at...)
+}
+
+// chunked reads at most n bytes at a time from r, like a tcp conn the
+// hello trickles in on
+type chunked struct {
+	r io.Reader
+	n int
+}
+
+func (c chunked) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func TestPeekHandshake(t *testing.T) {
+	hello := helloMsg(t, "split.example.com")
+	big := handshakeMsg(maxHello - 4)
+	appdata := record(0x17, []byte("after the hello"))
+
+	tests := []struct {
+		name string
+		in   []byte
+		msg  []byte // want; or nil
+		n    int    // bytes the hello's records span
+		err  error  // want; or nil
+		read func(io.Reader) io.Reader
+	}{
+		{name: "one record", in: fragment(hello), msg: hello, n: 5 + len(hello)},
+		{name: "two records", in: fragment(hello, len(hello)/2), msg: hello, n: 10 + len(hello)},
+		{name: "three records", in: fragment(hello, 40, len(hello)-7), msg: hello, n: 15 + len(hello)},
+		{name: "split in the handshake header", in: fragment(hello, 1, 3), msg: hello, n: 15 + len(hello)},
+		{name: "a record per byte", in: everyN(hello, 1), msg: hello, n: 6 * len(hello)},
+		{name: "records after the hello", in: append(fragment(hello, 100), appdata...), msg: hello, n: 10 + len(hello)},
+		{
+			name: "other messages after the hello, in the same record",
+			in:   fragment(append(append([]byte{}, hello...), handshakeMsg(8)...)),
+			msg:  hello, n: 5 + len(hello) + 12,
+		},
+		{
+			name: "one byte reads", in: fragment(hello), msg: hello, n: 5 + len(hello),
+			read: iotest.OneByteReader,
+		},
+		{
+			name: "small reads across three records", in: fragment(hello, 40, len(hello)-7), msg: hello, n: 15 + len(hello),
+			read: func(r io.Reader) io.Reader { return chunked{r, 7} },
+		},
+		{
+			name: "small reads that split record headers", in: everyN(hello, 64), msg: hello,
+			n:    5*((len(hello)+63)/64) + len(hello),
+			read: func(r io.Reader) io.Reader { return chunked{r, 3} },
+		},
+		{name: "largest hello", in: fragment(big, maxHello/2), msg: big, n: 10 + maxHello},
+		{name: "hello too large", in: fragment(handshakeMsg(maxHello - 3)), err: errBadHello},
+		{name: "too many records", in: everyN(handshakeMsg(4000), 1), err: errBadHello},
+		{
+			name: "alert in the middle",
+			in:   append(append(fragment(hello[:50]), record(recordTypeAlert, []byte{2, 40})...), fragment(hello[50:])...),
+			err:  errBadHello,
+		},
+		{
+			name: "application data in the middle",
+			in:   append(append(fragment(hello[:2]), appdata...), fragment(hello[2:])...),
+			err:  errBadHello,
+		},
+		{name: "not a handshake", in: appdata, err: errBadHello},
+		{name: "empty record", in: append(record(recordTypeHandshake, nil), fragment(hello)...), err: errBadHello},
+		{name: "truncated", in: fragment(hello)[:len(hello)-10], err: io.EOF},
+		{name: "truncated across records", in: fragment(hello, 60)[:70], err: io.EOF},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tc.in)
+			if tc.read != nil {
+				r = tc.read(r)
+			}
+			br := bufio.NewReaderSize(r, helloBufSize)
+
+			msg, n, err := peekHandshake(br)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("want err %v; got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg, tc.msg) {
+				t.Fatalf("want msg of %d bytes; got %d", len(tc.msg), len(msg))
+			}
+			if n != tc.n {
+				t.Fatalf("want records spanning %d bytes; got %d", tc.n, n)
+			}
+			// nothing is consumed
+			all, err := io.ReadAll(br)
+			if err != nil || !bytes.Equal(all, tc.in) {
+				t.Fatalf("br consumed; %d of %d bytes left (err %v)", len(all), len(tc.in), err)
+			}
+		})
+	}
+}
+
+func TestReadClientHelloSplit(t *testing.T) {
+	hello := helloMsg(t, "split.example.com")
+	for _, in := range [][]byte{fragment(hello), fragment(hello, len(hello)/2), fragment(hello, 1, 3), everyN(hello, 1)} {
+		br := bufio.NewReaderSize(iotest.HalfReader(bytes.NewReader(in)), helloBufSize)
+		h := readClientHello(br)
+		if h == nil {
+			t.Fatalf("no hello in %d bytes", len(in))
+		}
+		if h.ServerName != "split.example.com" || len(h.ALPN) != 2 || h.ALPN[0] != "h2" {
+			t.Fatalf("got sni %q alpn %v", h.ServerName, h.ALPN)
+		}
+	}
+}
+
+func BenchmarkReadClientHello(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"one record", fragment(helloMsg(b, "bench.example.com"))},
+		{"three records", fragment(helloMsg(b, "bench.example.com"), 40, 200)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			r := bytes.NewReader(bc.in)
+			br := bufio.NewReaderSize(r, helloBufSize)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bc.in)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(bc.in)
+				br.Reset(r)
+				if readClientHello(br) == nil {
+					b.Fatal("no hello")
+				}
+			}
+		})
+	}
+}
+
+// fpHello is the stuff of a ClientHello fingerprinted by JA3 and JA4
+type fpHello struct {
+	version  uint16
+	ciphers  []uint16
+	exts     []uint16 // in the order sent; data as per the fields below
+	groups   []uint16
+	formats  []uint8
+	sigalgs  []uint16
+	versions []uint16
+	alpn     []string
+}
+
+func u16s(vs []uint16) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = append16(b, v)
+	}
+	return b
+}
+
+func (f fpHello) msg() []byte {
+	var exts []byte
+	for _, typ := range f.exts {
+		var data []byte
+		switch typ {
+		case extServerName:
+			data = appendVec(nil, 2, appendVec([]byte{0}, 2, []byte("fp.example")))
+		case extSupportedGroups:
+			data = appendVec(nil, 2, u16s(f.groups))
+		case extECPointFormats:
+			data = appendVec(nil, 1, f.formats)
+		case extSignatureAlgorithms:
+			data = appendVec(nil, 2, u16s(f.sigalgs))
+		case extSupportedVersions:
+			data = appendVec(nil, 1, u16s(f.versions))
+		case extALPN:
+			var protos []byte
+			for _, p := range f.alpn {
+				protos = appendVec(protos, 1, []byte(p))
+			}
+			data = appendVec(nil, 2, protos)
+		case extKeyShare:
+			data = appendVec(nil, 2, appendVec(append16(nil, 0x001d), 2, make([]byte, 32)))
+		}
+		exts = append(exts, ext(typ, data)...)
+	}
+
+	body := append16(nil, f.version)
+	body = append(body, make([]byte, 32)...) // random
+	body = appendVec(body, 1, nil)           // session id
+	body = appendVec(body, 2, u16s(f.ciphers))
+	body = appendVec(body, 1, []byte{0})
+	if len(f.exts) > 0 {
+		body = appendVec(body, 2, exts)
+	}
+	return append([]byte{typeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+// withGrease returns vs with GREASE values at its head and tail
+func withGrease(vs ...uint16) []uint16 {
+	return append(append([]uint16{0x0a0a}, vs...), 0xfafa)
+}
+
+func TestFingerprints(t *testing.T) {
+	// github.com/salesforce/ja3#readme
+	ja3 := fpHello{
+		version: 0x0301,
+		ciphers: []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		exts:    []uint16{extServerName, extSupportedGroups, extECPointFormats},
+		groups:  []uint16{23, 24, 25},
+		formats: []uint8{0},
+	}
+	ja3grease := ja3
+	ja3grease.ciphers = withGrease(ja3.ciphers...)
+	ja3grease.exts = withGrease(ja3.exts...)
+	ja3grease.groups = withGrease(ja3.groups...)
+
+	// github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md, where
+	// ja4_r is t13d1516h2_002f,0035,009c,009d,1301,1302,1303,c013,c014,
+	// c02b,c02c,c02f,c030,cca8,cca9_0005,000a,000b,000d,0012,0015,0017,
+	// 001b,0023,002b,002d,0033,4469,ff01_0403,0804,0401,0503,0805,0501,
+	// 0806,0601; ciphers and exts here are as chrome sends them
+	chrome := fpHello{
+		version: 0x0303,
+		ciphers: withGrease(0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014,
+			0x009c, 0x009d, 0x002f, 0x0035),
+		exts: withGrease(0x001b, 0x0023, extKeyShare, extECPointFormats, 0x4469, extSupportedVersions, extServerName,
+			0xff01, extSignatureAlgorithms, 0x0012, extSupportedGroups, 0x002d, 0x0005, 0x0017, extALPN, 0x0015),
+		groups:   withGrease(0x001d, 0x0017, 0x0018),
+		formats:  []uint8{0},
+		sigalgs:  []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		versions: withGrease(0x0304, 0x0303),
+		alpn:     []string{"h2", "http/1.1"},
+	}
+	// the order of exts doesn't count
+	shuffled := chrome
+	shuffled.exts = withGrease(extALPN, 0x0015, 0x0005, 0x0017, extServerName, 0xff01, 0x001b, 0x0023, extKeyShare,
+		extSignatureAlgorithms, 0x0012, extSupportedGroups, 0x002d, extECPointFormats, 0x4469, extSupportedVersions)
+	// but alpn does; and sni, or its lack
+	h1 := shuffled
+	h1.alpn = []string{"http/1.1", "h2"}
+	for i, e := range h1.exts {
+		if e == extServerName {
+			h1.exts = append(h1.exts[:i:i], h1.exts[i+1:]...)
+			break
+		}
+	}
+
+	tests := []struct {
+		name string
+		h    fpHello
+		ja3  string
+		ja4  string
+	}{
+		{name: "ja3 readme", h: ja3, ja3: "ada70206e40642a3e4461f35503241d5"},
+		{name: "ja3 readme with grease", h: ja3grease, ja3: "ada70206e40642a3e4461f35503241d5"},
+		{
+			// 769,4-5-10-9-100-98-3-6-19-18-99,,,
+			name: "ja3 readme sans exts",
+			h:    fpHello{version: 0x0301, ciphers: []uint16{4, 5, 10, 9, 100, 98, 3, 6, 19, 18, 99}},
+			ja3:  "de350869b8c85de67a350c8d186f11e6",
+		},
+		{name: "ja4 chrome", h: chrome, ja4: "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{name: "ja4 chrome shuffled", h: shuffled, ja4: "t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		{name: "ja4 chrome sans sni, http/1.1 first", h: h1, ja4: "t13i1515h1_8daaf6152771_e5627efa2ab1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := parseClientHello(tc.h.msg())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := h.JA3(); len(tc.ja3) > 0 && got != tc.ja3 {
+				t.Fatalf("want ja3 %s; got %s", tc.ja3, got)
+			}
+			if got := h.JA4(); len(tc.ja4) > 0 && got != tc.ja4 {
+				t.Fatalf("want ja4 %s; got %s", tc.ja4, got)
+			}
+		})
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	for _, tc := range []struct {
+		alpn []string
+		want string
+	}{
+		{nil, "00"},
+		{[]string{"h2"}, "h2"},
+		{[]string{"http/1.1", "h2"}, "h1"},
+		{[]string{"h3"}, "h3"},
+		{[]string{"\xabc\xcd"}, "ad"}, // not alnum, and so, hex: "ab63cd"
+	} {
+		if got := ja4ALPN(tc.alpn); got != tc.want {
+			t.Fatalf("%q: want %s; got %s", tc.alpn, tc.want, got)
+		}
+	}
+}
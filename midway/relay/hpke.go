@@ -0,0 +1,146 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// rfc9180, base mode only, and only as the recipient
+const (
+	hpkeKemX25519    = 0x0020 // DHKEM(X25519, HKDF-SHA256)
+	hpkeKdfSha256    = 0x0001 // HKDF-SHA256
+	hpkeAeadAes128   = 0x0001 // AES-128-GCM
+	hpkeAeadAes256   = 0x0002 // AES-256-GCM
+	hpkeAeadChacha20 = 0x0003 // ChaCha20Poly1305
+
+	hpkeModeBase = 0x00
+)
+
+var errHpke = errors.New("hpke: cannot open")
+
+// hpkeOpen decrypts ct (with aad) sent to the holder of x25519 key sk
+// (whose public key is pk) by a sender who encapsulated enc with info,
+// as the first message of a context using cipher suite kdf / aead.
+func hpkeOpen(kdf, aead uint16, sk, pk, enc, info, aad, ct []byte) ([]byte, error) {
+	// decap, rfc9180 4.1
+	dh, err := curve25519.X25519(sk, enc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errHpke, err)
+	}
+	key, nonce, err := hpkeKeys(kdf, aead, dh, enc, pk, info)
+	if err != nil {
+		return nil, err
+	}
+	a, err := hpkeAEAD(aead, key)
+	if err != nil {
+		return nil, err
+	}
+	// the first message is sealed with seq 0, and so with the base nonce
+	pt, err := a.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errHpke, err)
+	}
+	return pt, nil
+}
+
+// hpkeKeys derives the key and base nonce of a base mode context for
+// suite kdf / aead from the x25519 shared point dh between the sender's
+// ephemeral key (whose public key is enc) and the recipient's key pk;
+// rfc9180 4.1 and 5.1
+func hpkeKeys(kdf, aead uint16, dh, enc, pk, info []byte) (key, nonce []byte, err error) {
+	if kdf != hpkeKdfSha256 {
+		return nil, nil, fmt.Errorf("%w: kdf %d", errHpke, kdf)
+	}
+	var nk int
+	switch aead {
+	case hpkeAeadAes128:
+		nk = 16
+	case hpkeAeadAes256, hpkeAeadChacha20:
+		nk = 32
+	default:
+		return nil, nil, fmt.Errorf("%w: aead %d", errHpke, aead)
+	}
+
+	kemid := suiteID("KEM", hpkeKemX25519)
+	eae := labeledExtract(kemid, nil, "eae_prk", dh)
+	shared, err := labeledExpand(kemid, eae, "shared_secret", concat(enc, pk), 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sid := suiteID("HPKE", hpkeKemX25519, kdf, aead)
+	pskidhash := labeledExtract(sid, nil, "psk_id_hash", nil)
+	infohash := labeledExtract(sid, nil, "info_hash", info)
+	ksctx := concat([]byte{hpkeModeBase}, pskidhash, infohash)
+	secret := labeledExtract(sid, shared, "secret", nil)
+	if key, err = labeledExpand(sid, secret, "key", ksctx, nk); err != nil {
+		return nil, nil, err
+	}
+	if nonce, err = labeledExpand(sid, secret, "base_nonce", ksctx, 12); err != nil {
+		return nil, nil, err
+	}
+	return key, nonce, nil
+}
+
+func hpkeAEAD(aead uint16, key []byte) (a cipher.AEAD, err error) {
+	if aead == hpkeAeadChacha20 {
+		a, err = chacha20poly1305.New(key)
+	} else {
+		var b cipher.Block
+		if b, err = aes.NewCipher(key); err == nil {
+			a, err = cipher.NewGCM(b)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errHpke, err)
+	}
+	return a, nil
+}
+
+// x25519Public is the public key of x25519 private key sk
+func x25519Public(sk []byte) ([]byte, error) {
+	return curve25519.X25519(sk, curve25519.Basepoint)
+}
+
+func suiteID(prefix string, ids ...uint16) []byte {
+	b := []byte(prefix)
+	for _, id := range ids {
+		b = append(b, byte(id>>8), byte(id))
+	}
+	return b
+}
+
+func labeledExtract(suite, salt []byte, label string, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, concat([]byte("HPKE-v1"), suite, []byte(label), ikm), salt)
+}
+
+func labeledExpand(suite, prk []byte, label string, info []byte, n int) ([]byte, error) {
+	l := []byte{byte(n >> 8), byte(n)}
+	out := make([]byte, n)
+	r := hkdf.Expand(sha256.New, prk, concat(l, []byte("HPKE-v1"), suite, []byte(label), info))
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, fmt.Errorf("%w: %v", errHpke, err)
+	}
+	return out, nil
+}
+
+func concat(bs ...[]byte) []byte {
+	var out []byte
+	for _, b := range bs {
+		out = append(out, b...)
+	}
+	return out
+}
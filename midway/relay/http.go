@@ -28,9 +28,12 @@ import (
 	"bufio"
 	"bytes"
 	"net/http"
+	"net/url"
 )
 
-func httpHostHeader(br *bufio.Reader) string {
+// httpHostHeader returns the host (sans port) of the http request in br;
+// and the port, if the request line has an absolute-form uri with one.
+func httpHostHeader(br *bufio.Reader) (host, port string) {
 	const maxPeek = 4 << 10
 	peekSize := 0
 	for {
@@ -48,20 +51,20 @@ func httpHostHeader(br *bufio.Reader) string {
 			if b[0] < 'A' || b[0] > 'Z' {
 				// Doesn't look like an HTTP verb
 				// (GET, POST, etc).
-				return ""
+				return "", ""
 			}
 			if bytes.Index(b, crlfcrlf) != -1 || bytes.Index(b, lflf) != -1 {
 				req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
 				if err != nil {
-					return ""
+					return "", ""
 				}
 				if len(req.Header["Host"]) > 1 {
 					// TODO(bradfitz): what does
 					// ReadRequest do if there are
 					// multiple Host headers?
-					return ""
+					return "", ""
 				}
-				return req.Host
+				return requestHost(req)
 			}
 		}
 		if err != nil {
@@ -77,16 +80,54 @@ var (
 	lf          = []byte("\n")
 	crlfcrlf    = []byte("\r\n\r\n")
 	lflf        = []byte("\n\n")
+	httpScheme  = []byte("http://")
 )
 
-func httpHostHeaderFromBytes(b []byte) string {
+func httpHostHeaderFromBytes(b []byte) (host, port string) {
+	// absolute-form uris take precedence over the Host header, rfc7230 5.4
+	if host, port := absoluteFormHost(untilEOL(b)); len(host) > 0 {
+		return host, port
+	}
 	if i := bytes.Index(b, lfHostColon); i != -1 {
-		return string(bytes.TrimSpace(untilEOL(b[i+len(lfHostColon):])))
+		host, _ := splitHost(string(bytes.TrimSpace(untilEOL(b[i+len(lfHostColon):]))))
+		return host, ""
 	}
 	if i := bytes.Index(b, lfhostColon); i != -1 {
-		return string(bytes.TrimSpace(untilEOL(b[i+len(lfhostColon):])))
+		host, _ := splitHost(string(bytes.TrimSpace(untilEOL(b[i+len(lfhostColon):]))))
+		return host, ""
+	}
+	return "", ""
+}
+
+// absoluteFormHost returns host and port (if any) in a request line
+// like "GET http://host:port/path HTTP/1.1"
+func absoluteFormHost(line []byte) (host, port string) {
+	parts := bytes.Fields(line)
+	if len(parts) < 2 || !bytes.HasPrefix(bytes.ToLower(parts[1]), httpScheme) {
+		return "", ""
+	}
+	if u, err := url.Parse(string(parts[1])); err == nil {
+		return u.Hostname(), u.Port()
 	}
-	return ""
+	return "", ""
+}
+
+// requestHost returns the host (sans port) req is for; and the port,
+// if req has an absolute-form uri with one. Ports in Host headers are
+// not for clients to pick the backend's port with.
+func requestHost(req *http.Request) (host, port string) {
+	host, port = splitHost(req.Host)
+	if !req.URL.IsAbs() {
+		port = ""
+	}
+	return host, port
+}
+
+// splitHost splits authority a, like host, host:port, or [ip6]:port,
+// into its host and port (empty if a has none)
+func splitHost(a string) (host, port string) {
+	u := url.URL{Host: a}
+	return u.Hostname(), u.Port()
 }
 
 // untilEOL returns v, truncated before the first '\n' byte, if any.
@@ -0,0 +1,93 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHostHeader(t *testing.T) {
+	tests := []struct {
+		name, req  string
+		host, port string
+	}{
+		{name: "host", req: "GET / HTTP/1.1\r\nHost: h.example\r\n\r\n", host: "h.example"},
+		{name: "host with port", req: "GET / HTTP/1.1\r\nHost: h.example:8080\r\n\r\n", host: "h.example"},
+		{name: "host ip6", req: "GET / HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n\r\n", host: "2001:db8::1"},
+		{name: "absolute", req: "GET http://a.example/x HTTP/1.1\r\nHost: h.example\r\n\r\n", host: "a.example"},
+		{
+			name: "absolute with port", req: "GET http://a.example:8080/x HTTP/1.1\r\nHost: h.example\r\n\r\n",
+			host: "a.example", port: "8080",
+		},
+		{
+			name: "absolute ip6 with port", req: "GET http://[2001:db8::1]:8080/ HTTP/1.1\r\nHost: h.example\r\n\r\n",
+			host: "2001:db8::1", port: "8080",
+		},
+		// sans the end of the head, the peeked bytes are searched as-is
+		{name: "partial", req: "GET / HTTP/1.1\r\nhost: h.example:81\r\nX: y", host: "h.example"},
+		{
+			name: "partial absolute with port", req: "POST HTTP://a.example:8443/ HTTP/1.1\r\nHost: h.example\r\n",
+			host: "a.example", port: "8443",
+		},
+		{name: "not http", req: "\x16\x03\x01\x00\x05hello", host: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tc.req))
+			host, port := httpHostHeader(br)
+			if host != tc.host || port != tc.port {
+				t.Fatalf("want %q %q; got %q %q", tc.host, tc.port, host, port)
+			}
+		})
+	}
+}
+
+func TestNewProxyConnAbsoluteForm(t *testing.T) {
+	req := "GET http://a.example:8080/x HTTP/1.1\r\nHost: a.example:8080\r\n\r\n"
+	c := NewProxyConn(&peekConn{r: bytes.NewReader([]byte(req))})
+	if c == nil {
+		t.Fatal("no conn")
+	}
+	if c.HostName != "a.example" || c.Port != "8080" {
+		t.Fatalf("want a.example 8080; got %q %q", c.HostName, c.Port)
+	}
+	if string(c.Peeked) != req {
+		t.Fatal("request not peeked as-is")
+	}
+
+	// policies match on the host sans port
+	p := &Policy{}
+	m, err := parseMatchers([]string{"host:a.example", "port:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.rules = append(p.rules, rule{allow: false, match: m, line: "deny host:a.example port:8080"})
+	if ok, _ := p.Allow(c); ok {
+		t.Fatal("want host:a.example port:8080 to match")
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	src := &Conn{ID: "1", Typ: "tcp", Port: "80"}
+	for _, tc := range []struct{ line, host, port string }{
+		{"GET / HTTP/1.1\r\nHost: h.example:8080", "h.example", "80"},
+		{"GET http://a.example:8080/ HTTP/1.1\r\nHost: h.example", "a.example", "8080"},
+		{"GET http://a.example/ HTTP/1.1\r\nHost: h.example", "a.example", "80"},
+	} {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tc.line + "\r\n\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := src.request(req, 0)
+		if r.HostName != tc.host || r.Port != tc.port {
+			t.Fatalf("%q: want %q %q; got %q %q", tc.line, tc.host, tc.port, r.HostName, r.Port)
+		}
+	}
+}
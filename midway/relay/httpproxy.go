@@ -0,0 +1,191 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const maxProxyReqHead = 16 << 10
+
+var errProxyReq = errors.New("bad request")
+
+// NewHttpProxyConn reads a request made to an explicit http proxy off
+// of c, which is either a "CONNECT host:port" to tunnel through, or a
+// request with an absolute-form uri, like "GET http://host/path". The
+// latter is rewritten to origin-form, stripped of proxy headers, and
+// sent on to the origin as-is, with "Connection: close". Requests must
+// carry Basic Proxy-Authorization for one of the proxy users. On errors,
+// c is sent a http error response, closed, and nil is returned.
+func NewHttpProxyConn(c net.Conn) *Conn {
+	br := bufio.NewReader(c)
+
+	_ = c.SetReadDeadline(time.Now().Add(conntimeout))
+	method, target, proto, hdrs, err := readProxyReqHead(br)
+	_ = c.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		log.Printf("httpproxy: %s from %s", err, c.RemoteAddr())
+		replyHttp(c, http.StatusBadRequest)
+		c.Close()
+		return nil
+	}
+
+	if user, ok := proxyAuthorized(hdrs); !ok {
+		log.Printf("httpproxy: %s %s from %s; auth failed for %q", method, target, c.RemoteAddr(), user)
+		_ = c.SetWriteDeadline(time.Now().Add(conntimeout))
+		fmt.Fprintf(c, "HTTP/1.1 407 %s\r\nProxy-Authenticate: Basic realm=\"midway\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+			http.StatusText(http.StatusProxyAuthRequired))
+		c.Close()
+		return nil
+	}
+
+	var host, port string
+	var head []byte
+	connect := method == http.MethodConnect
+	if connect {
+		host, port, err = net.SplitHostPort(target)
+	} else {
+		host, port, head, err = originForm(method, target, proto, hdrs)
+	}
+	if err != nil || len(host) <= 0 || len(port) <= 0 {
+		log.Printf("httpproxy: %s %s from %s; err: %v", method, target, c.RemoteAddr(), err)
+		replyHttp(c, http.StatusBadRequest)
+		c.Close()
+		return nil
+	}
+
+	// bytes the client sent after the request head, if any
+	buffered, _ := br.Peek(br.Buffered())
+	peeked := append(head, buffered...)
+
+	return &Conn{
+		ID:       nextConnID(),
+		Typ:      "tcp",
+		HostName: host,
+		Port:     port,
+		Peeked:   peeked,
+		Conn:     c,
+		ack: func(err error) {
+			if err == nil && connect {
+				fmt.Fprintf(c, "%s 200 Connection established\r\n\r\n", proto)
+			} else if errors.Is(err, errDenied) {
+				replyHttp(c, http.StatusForbidden)
+			} else if err != nil {
+				replyHttp(c, http.StatusBadGateway)
+			} // else: the origin responds to the rewritten request
+		},
+	}
+}
+
+// readProxyReqHead reads in the request line and header lines of a
+// http/1.x request from br.
+func readProxyReqHead(br *bufio.Reader) (method, target, proto string, hdrs []string, err error) {
+	total := 0
+	readline := func() (string, error) {
+		l, err := br.ReadString('\n')
+		if total += len(l); total > maxProxyReqHead {
+			return "", fmt.Errorf("%w: head too large", errProxyReq)
+		}
+		return strings.TrimRight(l, "\r\n"), err
+	}
+
+	l, err := readline()
+	if err != nil {
+		return
+	}
+	parts := strings.Split(l, " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		err = fmt.Errorf("%w: %q", errProxyReq, l)
+		return
+	}
+	method, target, proto = parts[0], parts[1], parts[2]
+
+	for {
+		if l, err = readline(); err != nil {
+			return
+		}
+		if len(l) <= 0 {
+			return // end of head
+		}
+		hdrs = append(hdrs, l)
+	}
+}
+
+// proxyAuthorized tells whether the Basic Proxy-Authorization header in
+// hdrs is that of a proxy user; and which user it claims to be.
+func proxyAuthorized(hdrs []string) (string, bool) {
+	for _, h := range hdrs {
+		k, v, _ := strings.Cut(h, ":")
+		if http.CanonicalHeaderKey(strings.TrimSpace(k)) != "Proxy-Authorization" {
+			continue
+		}
+		scheme, cred, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if !strings.EqualFold(scheme, "basic") {
+			return "", false
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+		if err != nil {
+			return "", false
+		}
+		user, pass, _ := strings.Cut(string(b), ":")
+		return user, proxyAuth(user, pass)
+	}
+	return "", false
+}
+
+// originForm rewrites a request with an absolute-form uri to one with
+// an origin-form uri, and returns its host, port, and the new head.
+func originForm(method, target, proto string, hdrs []string) (host, port string, head []byte, err error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "http" || len(u.Host) <= 0 {
+		err = fmt.Errorf("%w: want absolute http uri, got %q", errProxyReq, target)
+		return
+	}
+	host, port = u.Hostname(), u.Port()
+	if len(port) <= 0 {
+		port = "80"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s %s\r\n", method, u.RequestURI(), proto)
+	hashost := false
+	for _, h := range hdrs {
+		k, _, _ := strings.Cut(h, ":")
+		switch http.CanonicalHeaderKey(strings.TrimSpace(k)) {
+		case "Proxy-Connection", "Proxy-Authorization", "Connection", "Keep-Alive":
+			continue // hop-by-hop
+		case "Host":
+			hashost = true
+		}
+		b.WriteString(h)
+		b.WriteString("\r\n")
+	}
+	if !hashost {
+		fmt.Fprintf(&b, "Host: %s\r\n", u.Host)
+	}
+	// subsequent requests on this conn may well be for other hosts
+	b.WriteString("Connection: close\r\n\r\n")
+	return host, port, b.Bytes(), nil
+}
+
+func replyHttp(c net.Conn, code int) {
+	_ = c.SetWriteDeadline(time.Now().Add(conntimeout))
+	fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
@@ -0,0 +1,465 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// l7idletimeout caps how long idle backend conns are kept for reuse
+const l7idletimeout = 90 * time.Second
+
+// l7transports are http transports that pool backend conns across
+// client conns; but not for targets sent proxy-proto headers, which
+// identify the client, and so are pooled per client conn.
+var l7transports = newTransports()
+
+// hop-by-hop headers, rfc7230 6.1; as in net/http/httputil
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type l7key struct{}
+
+// l7req is what the transport dials a backend for
+type l7req struct {
+	c  *Conn
+	to Target
+}
+
+// ForwardHTTP relays each http/1.x request on src to the backend routed
+// (and allowed by policy) for its own Host, over backend conns reused
+// across requests; and upgrade requests (websockets, say) by piping the
+// rest of src to that request's backend. Bodies are shaped as bytes
+// piped to and from the backend are.
+func (src *Conn) ForwardHTTP() {
+	defer src.Close()
+
+	if !streams.add(src) {
+		log.Printf("relay: %s draining; drop conn from %s", src.ID, src.RemoteAddr())
+		return
+	}
+	defer streams.remove(src)
+
+	// requests in-flight are given up on once src is done, or cut
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streams.onCut(src, cancel)
+
+	// transports for this conn alone; see l7transports
+	own := make(map[string]*http.Transport)
+	defer func() {
+		for _, tr := range own {
+			tr.CloseIdleConnections()
+		}
+	}()
+
+	// shapers for this conn, by target and host, so that requests to
+	// the same backend share the per-conn rate
+	shapers := make(map[string]*[2]*shaped)
+	defer func() {
+		for _, sh := range shapers {
+			sh[up].release()
+			sh[down].release()
+		}
+	}()
+	shape := func(r *Conn, to Target) *[2]*shaped {
+		key := to.String() + "|" + r.HostName
+		if sh := shapers[key]; sh != nil {
+			return sh
+		}
+		sh := &[2]*shaped{shaper(r, to, up), shaper(r, to, down)}
+		shapers[key] = sh
+		return sh
+	}
+
+	// src covers for its peeked bytes
+	ic := &idleConn{Conn: src}
+	br := bufio.NewReader(ic)
+	bw := bufio.NewWriter(ic)
+
+	for n := 0; ; n++ {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if n <= 0 || !errors.Is(err, io.EOF) {
+				log.Printf("relay: %s http req #%d from %s; err %v", src.ID, n, src.RemoteAddr(), err)
+			}
+			return
+		}
+		r := src.request(req, n)
+		to := router.Load().Route(r)
+
+		if r.disallow(to) {
+			replyHttp(src, http.StatusForbidden)
+			return
+		}
+		if isUpgrade(req.Header) {
+			r.Peeked = unread(src, br)
+			src.upgrade(r, to, req)
+			return
+		}
+
+		sh := shape(r, to)
+		body := &readBody{ReadCloser: req.Body}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = body
+			if sh[up] != nil {
+				req.Body = &shapedBody{ReadCloser: body, sh: sh[up]}
+			}
+		} else {
+			body.eof = 1
+		}
+
+		start := time.Now()
+		res, err := roundTrip(ctx, own, r, to, req)
+		if err != nil {
+			log.Printf("relay: %s %s http://%s%s => %s; err %v", r.ID, req.Method, req.Host, req.URL.RequestURI(), to, err)
+			replyHttp(src, http.StatusBadGateway)
+			return
+		}
+
+		// a request body the backend didn't read all of can't be told
+		// apart from the next request; and conns draining are let go
+		keepalive := !req.Close && !res.Close && body.done() && !streams.quitting()
+		if req.ProtoMajor == 1 && req.ProtoMinor == 0 {
+			// http/1.0 clients can't be sent chunked bodies, so
+			// delimit bodies of unknown length by closing src
+			res.ProtoMajor, res.ProtoMinor = 1, 0
+			if res.ContentLength < 0 {
+				res.TransferEncoding = nil
+				keepalive = false
+			}
+		}
+		removeHopHeaders(res.Header)
+		res.Close = !keepalive
+		if sh[down] != nil {
+			res.Body = &shapedBody{ReadCloser: res.Body, sh: sh[down]}
+		}
+
+		err = res.Write(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		res.Body.Close()
+
+		log.Printf("relay: %s %s http://%s%s => %s (%d) in %s", r.ID, req.Method, req.Host, req.URL.RequestURI(),
+			to, res.StatusCode, time.Since(start).Round(time.Millisecond))
+		if err != nil || !keepalive {
+			return
+		}
+	}
+}
+
+// request is a conn for req, the n-th request on src, that's routed and
+// matched against the policy on its own
+func (src *Conn) request(req *http.Request, n int) *Conn {
+	host, port := requestHost(req)
+	if len(port) <= 0 {
+		port = src.Port
+	}
+	return &Conn{
+		ID:       fmt.Sprintf("%s.%d", src.ID, n),
+		Typ:      src.Typ,
+		Proto:    ProtoHTTP,
+		HostName: host,
+		Port:     port,
+		Conn:     src.Conn,
+	}
+}
+
+// unread returns the bytes of src past those read off br, which reads
+// src: what br buffered, and then, what's left of src.Peeked.
+func unread(src *Conn, br *bufio.Reader) []byte {
+	buffered, _ := br.Peek(br.Buffered())
+	b := append([]byte(nil), buffered...)
+	b = append(b, src.Peeked...)
+	src.Peeked = nil
+	return b
+}
+
+// roundTrip sends req, on behalf of r, to target to over a pooled conn,
+// until ctx is done
+func roundTrip(ctx context.Context, own map[string]*http.Transport, r *Conn, to Target, req *http.Request) (*http.Response, error) {
+	key := to.String()
+	var tr *http.Transport
+	if to.ProxyProto > 0 {
+		if tr = own[key]; tr == nil {
+			tr = newTransport()
+			own[key] = tr
+		}
+	} else {
+		tr = l7transports.get(key)
+	}
+
+	// conns are pooled by the addr dialed; which, for pools, stands in
+	// for all the pool's members
+	req.URL.Scheme = "http"
+	req.URL.Host = to.hostport(r)
+	req.RequestURI = ""
+	removeHopHeaders(req.Header)
+	addForwarded(r, req)
+
+	ctx = context.WithValue(ctx, l7key{}, &l7req{r, to})
+	return tr.RoundTrip(req.WithContext(ctx))
+}
+
+// upgrade pipes r to target to, once it is sent req, an upgrade request
+func (src *Conn) upgrade(r *Conn, to Target, req *http.Request) {
+	log.Printf("relay: %s %s http://%s%s => %s; upgrade %q", r.ID, req.Method, req.Host, req.URL.RequestURI(),
+		to, req.Header.Get("Upgrade"))
+
+	dst, done, err := dialL7(r, to)
+	if err != nil {
+		log.Printf("relay: %s upgrade dial err %v", r.ID, err)
+		replyHttp(src, http.StatusBadGateway)
+		return
+	}
+	defer done()
+	defer dst.Close()
+
+	// the backend needs the hop-by-hop headers an upgrade is asked with
+	addForwarded(r, req)
+	if err := req.Write(dst); err != nil {
+		log.Printf("relay: %s upgrade req err %v", r.ID, err)
+		return
+	}
+	_ = src.SetDeadline(time.Time{})
+	newPipe(r, dst).run(to)
+}
+
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialTransport,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   8,
+		IdleConnTimeout:       l7idletimeout,
+		ResponseHeaderTimeout: l7headertimeout(),
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    true,
+		// http/1.x only
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}
+}
+
+// transports are http transports by the string of the target (kind,
+// dst, via, and class) they're for, and so, all routes over dns with
+// the same options share one; each pools conns by the addr dialed.
+// Transports not used for l7idletimeout are closed, along with their
+// idle conns.
+type transports struct {
+	mu sync.Mutex
+	m  map[string]*transport
+}
+
+type transport struct {
+	*http.Transport
+	used time.Time
+}
+
+func newTransports() *transports {
+	ts := &transports{m: make(map[string]*transport)}
+	go ts.gc()
+	return ts
+}
+
+// get returns the transport for key, creating it if need be
+func (ts *transports) get(key string) *http.Transport {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.m[key]
+	if t == nil {
+		t = &transport{Transport: newTransport()}
+		ts.m[key] = t
+	}
+	t.used = time.Now()
+	return t.Transport
+}
+
+func (ts *transports) gc() {
+	for range time.Tick(l7idletimeout) {
+		ts.sweep(time.Now())
+	}
+}
+
+// sweep closes transports not used for l7idletimeout before now
+func (ts *transports) sweep(now time.Time) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for k, t := range ts.m {
+		// conns in use when t is let go are closed once idle, after
+		// l7idletimeout
+		if now.Sub(t.used) > l7idletimeout {
+			t.CloseIdleConnections()
+			delete(ts.m, k)
+		}
+	}
+}
+
+// dialTransport dials the target in ctx; and not addr, which is but a
+// key transports pool conns by
+func dialTransport(ctx context.Context, _, _ string) (net.Conn, error) {
+	lr, ok := ctx.Value(l7key{}).(*l7req)
+	if !ok {
+		return nil, errProxyReq
+	}
+	dst, done, err := dialL7(lr.c, lr.to)
+	if err != nil {
+		return nil, err
+	}
+	// backends that stall mid-body are given up on, too
+	return &doneConn{Conn: &idleConn{Conn: dst}, done: done}, nil
+}
+
+// l7headertimeout is how long a backend may take to respond to a request;
+// as long as a relayed conn may idle, or, if it may idle forever,
+// conntimeout.
+func l7headertimeout() time.Duration {
+	if idletimeout > 0 {
+		return idletimeout
+	}
+	return conntimeout
+}
+
+// dialL7 dials target to on behalf of r, and sends it a proxy-proto
+// header, if need be.
+func dialL7(r *Conn, to Target) (net.Conn, func(), error) {
+	dst, done, err := to.dial(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if to.ProxyProto > 0 {
+		if err := writeProxyHeader(dst, to.ProxyProto, r); err != nil {
+			dst.Close()
+			done()
+			return nil, nil, err
+		}
+	}
+	return dst, done, nil
+}
+
+// addForwarded appends r's client to the X-Forwarded-For and Forwarded
+// (rfc7239) headers of req
+func addForwarded(r *Conn, req *http.Request) {
+	ip, ok := clientIP(r)
+	if !ok {
+		return
+	}
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip.String())
+	} else {
+		req.Header.Set("X-Forwarded-For", ip.String())
+	}
+	node := ip.String()
+	if ip.Is6() {
+		node = `"[` + node + `]"`
+	}
+	fwd := "for=" + node + ";proto=http"
+	if len(r.HostName) > 0 {
+		fwd += `;host="` + req.Host + `"`
+	}
+	req.Header.Add("Forwarded", fwd)
+}
+
+// isUpgrade tells whether h asks for a protocol switch
+func isUpgrade(h http.Header) bool {
+	return len(h.Get("Upgrade")) > 0 && hasToken(h.Values("Connection"), "upgrade")
+}
+
+// removeHopHeaders removes hop-by-hop headers, and those named in the
+// Connection header, from h
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); len(k) > 0 {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+func hasToken(vs []string, token string) bool {
+	for _, v := range vs {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idleConn extends its deadline on every read and write by idletimeout
+type idleConn struct {
+	net.Conn
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if idletimeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(idletimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if idletimeout > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(idletimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// readBody notes whether a request body was read till its end
+type readBody struct {
+	io.ReadCloser
+	eof int32
+}
+
+func (b *readBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		atomic.StoreInt32(&b.eof, 1)
+	}
+	return n, err
+}
+
+func (b *readBody) done() bool {
+	return atomic.LoadInt32(&b.eof) == 1
+}
+
+// doneConn calls done once it is closed
+type doneConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+func (c *doneConn) Close() error {
+	c.once.Do(c.done)
+	return c.Conn.Close()
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportsSweep(t *testing.T) {
+	ts := &transports{m: make(map[string]*transport)}
+	a := ts.get("dns")
+	if ts.get("dns") != a {
+		t.Fatal("want one transport per key")
+	}
+	b := ts.get("pool:origins")
+
+	ts.m["dns"].used = time.Now().Add(-2 * l7idletimeout)
+	ts.sweep(time.Now())
+	if _, ok := ts.m["dns"]; ok {
+		t.Fatal("want unused transports closed")
+	}
+	if ts.m["pool:origins"] == nil || ts.get("pool:origins") != b {
+		t.Fatal("want transports in use kept")
+	}
+	if ts.get("dns") == a {
+		t.Fatal("want a new transport for a key once swept")
+	}
+}
+
+func TestUnread(t *testing.T) {
+	req := "GET /ws HTTP/1.1\r\nHost: h.example\r\nConnection: upgrade\r\nUpgrade: websocket\r\n\r\n"
+	// more than br buffers at a time, so some of it is left in Peeked
+	frames := strings.Repeat("f", 3*4096)
+	c, _ := net.Pipe()
+	defer c.Close()
+	src := &Conn{Peeked: []byte(req + frames), Conn: c}
+	br := bufio.NewReader(&idleConn{Conn: src})
+
+	if _, err := http.ReadRequest(br); err != nil {
+		t.Fatal(err)
+	}
+	if len(src.Peeked) <= 0 {
+		t.Fatal("want bytes left in src.Peeked")
+	}
+	if got := unread(src, br); string(got) != frames {
+		t.Fatalf("want %d bytes past the request; got %d", len(frames), len(got))
+	}
+	if len(src.Peeked) != 0 {
+		t.Fatal("want src.Peeked handed over")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/gateway/midway/env"
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+const (
+	shedClose = "close" // close shed conns (with a FIN)
+	shedReset = "reset" // abort shed conns (with a RST)
+)
+
+var admission = newLimiter(
+	env.LimitConnsPerClient(),
+	env.LimitNewConnsPerSec(),
+	env.LimitMaxConns(),
+	env.LimitClientPrefix4(),
+	env.LimitClientPrefix6(),
+	env.LimitShed(),
+)
+
+// limiter caps concurrent conns and the rate of new conns from each
+// client (grouped by ip prefix), and concurrent conns overall. Limits
+// that are <= 0 aren't enforced.
+type limiter struct {
+	perclient int     // max concurrent conns per client
+	rate      float64 // new conns per sec per client
+	burst     float64 // token bucket size; twice the rate
+	global    int64   // max concurrent conns overall
+	bits4     int     // prefix len clients ip4s are grouped by
+	bits6     int     // prefix len clients ip6s are grouped by
+	shed      string  // shedClose or shedReset
+
+	active int64  // concurrent conns overall
+	shedn  uint64 // total shed conns, for logs
+
+	mu      sync.Mutex
+	clients map[netip.Prefix]*client
+}
+
+type client struct {
+	active int       // concurrent conns
+	tokens float64   // for new conns
+	last   time.Time // of the last token refill
+}
+
+func newLimiter(perclient, rate, global, bits4, bits6 int64, shed string) *limiter {
+	if shed != shedClose {
+		shed = shedReset
+	}
+	l := &limiter{
+		perclient: int(perclient),
+		rate:      float64(rate),
+		burst:     float64(rate) * 2,
+		global:    global,
+		bits4:     int(bits4),
+		bits6:     int(bits6),
+		shed:      shed,
+		clients:   make(map[netip.Prefix]*client),
+	}
+	if l.enabled() {
+		log.Printf("limit: per-client %d conns, %d new conns/s; overall %d conns; shed: %s",
+			perclient, rate, global, shed)
+		go l.gc()
+	}
+	return l
+}
+
+func (l *limiter) enabled() bool {
+	return l.perclient > 0 || l.rate > 0 || l.global > 0
+}
+
+// Admit lets c through if no limits are breached; returning c
+// wrapped such that closing it releases its slot. Otherwise, c is
+// shed (closed or reset) and false is returned. Admit must be called
+// before any bytes are read from c.
+func Admit(c net.Conn) (net.Conn, bool) {
+	return admission.admit(c)
+}
+
+func (l *limiter) admit(c net.Conn) (net.Conn, bool) {
+	if !l.enabled() {
+		return c, true
+	}
+
+	if n := atomic.AddInt64(&l.active, 1); l.global > 0 && n > l.global {
+		atomic.AddInt64(&l.active, -1)
+		l.drop(c, "overload")
+		return nil, false
+	}
+
+	key, ok := l.key(c)
+	if !ok {
+		// no client ip (unix socket?), only the global limit applies
+		return l.wrap(c, netip.Prefix{}), true
+	}
+
+	if why := l.take(key); len(why) > 0 {
+		atomic.AddInt64(&l.active, -1)
+		l.drop(c, why)
+		return nil, false
+	}
+	return l.wrap(c, key), true
+}
+
+// take reserves a conn slot for client key, or says why it can't
+func (l *limiter) take(key netip.Prefix) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	cl := l.clients[key]
+	if cl == nil {
+		cl = &client{tokens: l.burst, last: now}
+		l.clients[key] = cl
+	}
+
+	if l.perclient > 0 && cl.active >= l.perclient {
+		return "too many conns"
+	}
+	if l.rate > 0 {
+		cl.tokens += now.Sub(cl.last).Seconds() * l.rate
+		if cl.tokens > l.burst {
+			cl.tokens = l.burst
+		}
+		cl.last = now
+		if cl.tokens < 1 {
+			return "too many new conns"
+		}
+		cl.tokens--
+	}
+	cl.active++
+	return ""
+}
+
+func (l *limiter) release(key netip.Prefix) {
+	atomic.AddInt64(&l.active, -1)
+	if !key.IsValid() {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cl := l.clients[key]; cl != nil {
+		cl.active--
+	}
+}
+
+// gc forgets idle clients whose token buckets are full again
+func (l *limiter) gc() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		now := time.Now()
+		for k, cl := range l.clients {
+			refilled := l.rate <= 0 || cl.tokens+now.Sub(cl.last).Seconds()*l.rate >= l.burst
+			if cl.active <= 0 && refilled {
+				delete(l.clients, k)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// key is the prefix of the client ip of c that limits apply to
+func (l *limiter) key(c net.Conn) (netip.Prefix, bool) {
+	ipport, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	ip := ipport.Addr().Unmap()
+	bits := l.bits6
+	if ip.Is4() {
+		bits = l.bits4
+	}
+	if bits <= 0 || bits > ip.BitLen() {
+		bits = ip.BitLen()
+	}
+	pfx, err := ip.Prefix(bits)
+	return pfx, err == nil
+}
+
+func (l *limiter) drop(c net.Conn, why string) {
+	if n := atomic.AddUint64(&l.shedn, 1); n == 1 || n%1000 == 0 {
+		log.Printf("limit: %s; shed (%s) %s; total shed: %d", why, l.shed, c.RemoteAddr(), n)
+	}
+	if l.shed == shedReset {
+		if tc := asTCPConn(c); tc != nil {
+			// rst instead of fin
+			_ = tc.SetLinger(0)
+		}
+	}
+	c.Close()
+}
+
+func (l *limiter) wrap(c net.Conn, key netip.Prefix) net.Conn {
+	return &limitedConn{Conn: c, done: func() { l.release(key) }}
+}
+
+// limitedConn releases its slot with the limiter once closed
+type limitedConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.done)
+	return c.Conn.Close()
+}
+
+// ReadFrom and WriteTo let io.Copy splice, if c.Conn can
+func (c *limitedConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+func (c *limitedConn) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := c.Conn.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{c.Conn})
+}
+
+func asTCPConn(c net.Conn) *net.TCPConn {
+	switch x := c.(type) {
+	case *net.TCPConn:
+		return x
+	case *proxyproto.Conn:
+		tc, _ := x.TCPConn()
+		return tc
+	case *limitedConn:
+		return asTCPConn(x.Conn)
+	case *Conn:
+		return asTCPConn(x.Conn)
+	}
+	return nil
+}
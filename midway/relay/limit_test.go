@@ -0,0 +1,139 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// shedConn is a net.Conn from the client at remote that notes if closed
+type shedConn struct {
+	net.Conn // nil; unused
+	remote   net.Addr
+	closed   bool
+}
+
+func (c *shedConn) RemoteAddr() net.Addr { return c.remote }
+func (c *shedConn) Close() error         { c.closed = true; return nil }
+
+func dialer(ip string) *shedConn {
+	return &shedConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+// admits tells whether l admits a conn from ip; and if so, the conn
+func admits(t *testing.T, l *limiter, ip string) (net.Conn, bool) {
+	t.Helper()
+	c := dialer(ip)
+	lc, ok := l.admit(c)
+	if ok == c.closed {
+		t.Fatalf("%s: want shed conns closed, and only those; admitted %t, closed %t", ip, ok, c.closed)
+	}
+	return lc, ok
+}
+
+func TestLimiterPerClient(t *testing.T) {
+	l := newLimiter(2, 0, 0, 24, 64, shedClose)
+
+	a, _ := admits(t, l, "10.0.0.1")
+	if _, ok := admits(t, l, "10.0.0.2"); !ok {
+		t.Fatal("want the 2nd conn admitted")
+	}
+	// clients are grouped by their /24
+	if _, ok := admits(t, l, "10.0.0.3"); ok {
+		t.Fatal("want the 3rd conn of 10.0.0.0/24 shed")
+	}
+	if _, ok := admits(t, l, "10.0.1.1"); !ok {
+		t.Fatal("want conns of other clients admitted")
+	}
+	if _, ok := admits(t, l, "2001:db8::1"); !ok {
+		t.Fatal("want conns of other clients admitted")
+	}
+
+	// closes, however many, free one slot
+	a.Close()
+	a.Close()
+	if _, ok := admits(t, l, "10.0.0.1"); !ok {
+		t.Fatal("want a conn admitted once one closed")
+	}
+	if _, ok := admits(t, l, "10.0.0.1"); ok {
+		t.Fatal("want a double close to free one slot")
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := newLimiter(0, 1, 0, 32, 128, shedReset)
+
+	// the burst is twice the rate
+	for i := 0; i < 2; i++ {
+		c, ok := admits(t, l, "192.0.2.1")
+		if !ok {
+			t.Fatalf("want conn #%d of the burst admitted", i)
+		}
+		c.Close() // rates apply to new conns, open or not
+	}
+	if _, ok := admits(t, l, "192.0.2.1"); ok {
+		t.Fatal("want conns past the burst shed")
+	}
+	if _, ok := admits(t, l, "192.0.2.2"); !ok {
+		t.Fatal("want conns of other clients admitted")
+	}
+
+	// a sec later, a token is back
+	key := netip.MustParsePrefix("192.0.2.1/32")
+	l.mu.Lock()
+	l.clients[key].last = l.clients[key].last.Add(-time.Second)
+	l.mu.Unlock()
+	if _, ok := admits(t, l, "192.0.2.1"); !ok {
+		t.Fatal("want a conn admitted once refilled")
+	}
+	if _, ok := admits(t, l, "192.0.2.1"); ok {
+		t.Fatal("want just the one token refilled")
+	}
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	l := newLimiter(0, 0, 2, 32, 128, shedClose)
+
+	a, _ := admits(t, l, "192.0.2.1")
+	admits(t, l, "192.0.2.2")
+	if _, ok := admits(t, l, "192.0.2.3"); ok {
+		t.Fatal("want conns over the global limit shed")
+	}
+	a.Close()
+	if _, ok := admits(t, l, "192.0.2.3"); !ok {
+		t.Fatal("want a conn admitted once one closed")
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l := newLimiter(0, 0, 0, 32, 128, "")
+	if l.shed != shedReset {
+		t.Fatalf("want conns reset by default; got %s", l.shed)
+	}
+	c := dialer("192.0.2.1")
+	for i := 0; i < 100; i++ {
+		if lc, ok := l.admit(c); !ok || lc != c {
+			t.Fatal("want all conns admitted as-is")
+		}
+	}
+}
+
+func TestLimiterKey(t *testing.T) {
+	l := newLimiter(1, 0, 0, 24, 48, shedClose)
+	for _, tc := range []struct{ ip, key string }{
+		{"192.0.2.9", "192.0.2.0/24"},
+		{"::ffff:192.0.2.9", "192.0.2.0/24"},
+		{"2001:db8:1:2::9", "2001:db8:1::/48"},
+	} {
+		key, ok := l.key(dialer(tc.ip))
+		if !ok || key.String() != tc.key {
+			t.Errorf("%s: want %s; got %s", tc.ip, tc.key, key)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// matcher reports whether a conn satisfies a single condition
+type matcher func(c *Conn) bool
+
+var errNoMatcher = errors.New("relay: no such matcher")
+
+// parseMatcher parses one "kind:value" condition. Supported kinds:
+//
+//	host:www.example.com    exact hostname (case-insensitive)
+//	suffix:example.com      example.com and all its subdomains
+//	wild:*.example.com      glob, where * spans exactly one label
+//	regex:^ads?\.           regular expression on the hostname
+//	cidr:10.0.0.0/8         client ip (as seen via proxy-proto)
+//	port:443                port to relay to; which, for conns sniffed
+//	                        for host/sni, is the listener (local) port
+//	proto:ssh               protocol sniffed off of the conn; see sniff
+//	alpn:h2                 alpn offered in the tls ClientHello; or
+//	                        alpn:none, for hellos that offer none
+//	tlsver:1.3              max tls version offered; one of 1.0 to 1.3
+//	ja3:<md5 hex>           ja3 fingerprint of the tls ClientHello
+//	ja4:t13d1516h2_...      ja4 fingerprint of the tls ClientHello
+//	ech:inner               ech state of the tls conn; one of inner (if
+//	                        decrypted), outer (if not), or none
+//
+// "*" on its own matches every conn.
+func parseMatcher(tok string) (matcher, error) {
+	if tok == "*" {
+		return func(*Conn) bool { return true }, nil
+	}
+
+	kind, v, ok := strings.Cut(tok, ":")
+	if !ok || len(v) <= 0 {
+		return nil, fmt.Errorf("%w: %q", errNoMatcher, tok)
+	}
+
+	switch strings.ToLower(kind) {
+	case "host":
+		v = canonicalHost(v)
+		return func(c *Conn) bool {
+			return canonicalHost(c.HostName) == v
+		}, nil
+	case "suffix":
+		v = strings.TrimPrefix(canonicalHost(v), ".")
+		return func(c *Conn) bool {
+			h := canonicalHost(c.HostName)
+			return h == v || strings.HasSuffix(h, "."+v)
+		}, nil
+	case "wild":
+		labels := strings.Split(canonicalHost(v), ".")
+		for i := range labels {
+			if labels[i] == "*" {
+				labels[i] = "[^.]+"
+			} else {
+				labels[i] = regexp.QuoteMeta(labels[i])
+			}
+		}
+		re, err := regexp.Compile("^" + strings.Join(labels, `\.`) + "$")
+		if err != nil {
+			return nil, err
+		}
+		return func(c *Conn) bool {
+			return re.MatchString(canonicalHost(c.HostName))
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *Conn) bool {
+			return re.MatchString(canonicalHost(c.HostName))
+		}, nil
+	case "cidr":
+		pfx, err := netip.ParsePrefix(v)
+		if err != nil {
+			// a lone ip is a /32 or a /128
+			ip, err2 := netip.ParseAddr(v)
+			if err2 != nil {
+				return nil, err
+			}
+			pfx = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		pfx = pfx.Masked()
+		return func(c *Conn) bool {
+			ip, ok := clientIP(c)
+			return ok && pfx.Contains(ip)
+		}, nil
+	case "port":
+		return func(c *Conn) bool {
+			return c.Port == v
+		}, nil
+	case "proto":
+		v = strings.ToLower(v)
+		return func(c *Conn) bool {
+			return c.Proto == v
+		}, nil
+	case "alpn":
+		return func(c *Conn) bool {
+			if c.Hello == nil {
+				return false
+			} else if v == "none" {
+				return len(c.Hello.ALPN) <= 0
+			}
+			for _, p := range c.Hello.ALPN {
+				if p == v {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "tlsver":
+		vers := map[string]uint16{"1.0": 0x0301, "1.1": 0x0302, "1.2": 0x0303, "1.3": 0x0304}
+		ver, ok := vers[v]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q; want tlsver:1.0 to 1.3", errNoMatcher, tok)
+		}
+		return func(c *Conn) bool {
+			return c.Hello != nil && c.Hello.MaxVersion() == ver
+		}, nil
+	case "ja3":
+		v = strings.ToLower(v)
+		return func(c *Conn) bool {
+			return c.Hello != nil && c.Hello.JA3() == v
+		}, nil
+	case "ja4":
+		v = strings.ToLower(v)
+		return func(c *Conn) bool {
+			return c.Hello != nil && c.Hello.JA4() == v
+		}, nil
+	case "ech":
+		v = strings.ToLower(v)
+		if v == "none" {
+			v = ECHNone
+		} else if v != ECHInner && v != ECHOuter {
+			return nil, fmt.Errorf("%w: %q; want ech:inner, outer, or none", errNoMatcher, tok)
+		}
+		return func(c *Conn) bool {
+			return c.Proto == ProtoTLS && c.ECH == v
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", errNoMatcher, tok)
+}
+
+// parseMatchers parses all conditions in toks; all of which must
+// match for the returned matcher to match.
+func parseMatchers(toks []string) (matcher, error) {
+	if len(toks) <= 0 {
+		return nil, fmt.Errorf("%w: no conditions", errNoMatcher)
+	}
+	all := make([]matcher, 0, len(toks))
+	for _, tok := range toks {
+		m, err := parseMatcher(tok)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, m)
+	}
+	return func(c *Conn) bool {
+		for _, m := range all {
+			if !m(c) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func canonicalHost(h string) string {
+	return strings.TrimSuffix(strings.ToLower(h), ".")
+}
+
+// clientIP is the unmapped ip addr of the client that c came from
+func clientIP(c *Conn) (netip.Addr, bool) {
+	if c == nil || c.Conn == nil {
+		return netip.Addr{}, false
+	}
+	ipport, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ipport.Addr().Unmap(), true
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fromConn is a net.Conn from the client at remote
+type fromConn struct {
+	net.Conn // nil; unused
+	remote   net.Addr
+}
+
+func (c *fromConn) RemoteAddr() net.Addr { return c.remote }
+
+func from(ip string) net.Conn {
+	return &fromConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+func TestParseMatcher(t *testing.T) {
+	h2 := &ClientHello{Version: 0x0303, SupportedVersions: []uint16{0x0a0a, 0x0304, 0x0303}, ALPN: []string{"h2", "http/1.1"}}
+	h2.ja3, h2.ja4 = "ada70206e40642a3e4461f35503241d5", "t13d1516h2_8daaf6152771_e5627efa2ab1"
+	h12 := &ClientHello{Version: 0x0303}
+
+	host := func(h string) *Conn { return &Conn{HostName: h} }
+	tests := []struct {
+		tok  string
+		c    *Conn
+		want bool
+	}{
+		{"*", &Conn{}, true},
+		{"host:www.example.com", host("www.example.com"), true},
+		{"host:www.example.com", host("WWW.Example.COM."), true},
+		{"host:www.example.com", host("a.www.example.com"), false},
+		{"suffix:example.com", host("example.com"), true},
+		{"suffix:example.com", host("a.b.example.com"), true},
+		{"suffix:.example.com", host("a.example.com"), true},
+		{"suffix:example.com", host("notexample.com"), false},
+		{"wild:*.example.com", host("a.example.com"), true},
+		{"wild:*.example.com", host("a.b.example.com"), false},
+		{"wild:*.example.com", host("example.com"), false},
+		{"wild:a.*.example.com", host("a.b.example.com"), true},
+		{"wild:a.b.example.com", host("axb.example.com"), false}, // dots are literal
+		{"regex:^ads?\\.", host("ad.example.com"), true},
+		{"regex:^ads?\\.", host("bad.example.com"), false},
+		{"cidr:10.0.0.0/8", &Conn{Conn: from("10.1.2.3")}, true},
+		{"cidr:10.0.0.0/8", &Conn{Conn: from("11.1.2.3")}, false},
+		{"cidr:10.1.2.3", &Conn{Conn: from("10.1.2.3")}, true},
+		{"cidr:10.1.2.3/8", &Conn{Conn: from("10.9.9.9")}, true}, // masked
+		{"cidr:10.0.0.0/8", &Conn{Conn: from("::ffff:10.1.2.3")}, true},
+		{"cidr:2001:db8::/32", &Conn{Conn: from("2001:db8::1")}, true},
+		{"cidr:10.0.0.0/8", &Conn{}, false},
+		{"port:443", &Conn{Port: "443"}, true},
+		{"port:443", &Conn{Port: "80"}, false},
+		{"proto:SSH", &Conn{Proto: ProtoSSH}, true},
+		{"proto:ssh", &Conn{Proto: ProtoTLS}, false},
+		{"alpn:h2", &Conn{Hello: h2}, true},
+		{"alpn:http/1.1", &Conn{Hello: h2}, true},
+		{"alpn:h3", &Conn{Hello: h2}, false},
+		{"alpn:none", &Conn{Hello: h12}, true},
+		{"alpn:none", &Conn{Hello: h2}, false},
+		{"alpn:none", &Conn{}, false},
+		{"tlsver:1.3", &Conn{Hello: h2}, true},
+		{"tlsver:1.2", &Conn{Hello: h2}, false},
+		{"tlsver:1.2", &Conn{Hello: h12}, true},
+		{"tlsver:1.2", &Conn{}, false},
+		{"ja3:ADA70206E40642A3E4461F35503241D5", &Conn{Hello: h2}, true},
+		{"ja3:ada70206e40642a3e4461f35503241d5", &Conn{}, false},
+		{"ja4:t13d1516h2_8daaf6152771_e5627efa2ab1", &Conn{Hello: h2}, true},
+		{"ja4:t13d1516h2_8daaf6152771_000000000000", &Conn{Hello: h2}, false},
+		{"ech:inner", &Conn{Proto: ProtoTLS, ECH: ECHInner}, true},
+		{"ech:outer", &Conn{Proto: ProtoTLS, ECH: ECHInner}, false},
+		{"ech:none", &Conn{Proto: ProtoTLS, ECH: ECHNone}, true},
+		{"ech:none", &Conn{Proto: ProtoHTTP, ECH: ECHNone}, false},
+	}
+	for _, tc := range tests {
+		m, err := parseMatcher(tc.tok)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.tok, err)
+		}
+		if got := m(tc.c); got != tc.want {
+			t.Errorf("%s on %+v: want %t; got %t", tc.tok, tc.c, tc.want, got)
+		}
+	}
+}
+
+func TestParseMatcherErrors(t *testing.T) {
+	for _, tok := range []string{
+		"", "host", "host:", "nope:x", "regex:(", "cidr:10.0.0.0/33", "cidr:nope",
+		"tlsver:1.4", "ech:maybe",
+	} {
+		if _, err := parseMatcher(tok); err == nil {
+			t.Errorf("%q: want err", tok)
+		}
+	}
+	if _, err := parseMatchers(nil); !errors.Is(err, errNoMatcher) {
+		t.Errorf("no conditions: want errNoMatcher; got %v", err)
+	}
+}
+
+func TestParseMatchers(t *testing.T) {
+	m, err := parseMatchers([]string{"suffix:example.com", "port:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		c    *Conn
+		want bool
+	}{
+		{&Conn{HostName: "a.example.com", Port: "443"}, true},
+		{&Conn{HostName: "a.example.com", Port: "80"}, false},
+		{&Conn{HostName: "a.example.org", Port: "443"}, false},
+	} {
+		if got := m(tc.c); got != tc.want {
+			t.Errorf("%s:%s: want %t; got %t", tc.c.HostName, tc.c.Port, tc.want, got)
+		}
+	}
+}
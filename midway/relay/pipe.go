@@ -0,0 +1,272 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/gateway/midway/env"
+)
+
+var (
+	idletimeout = env.RelayIdleTimeoutSec()
+	maxlifetime = env.RelayMaxLifetimeSec()
+
+	errAborted     = errors.New("relay: other direction failed")
+	errNoHalfClose = errors.New("relay: half-close unsupported")
+
+	copybufs = sync.Pool{New: func() any {
+		b := make([]byte, 32<<10)
+		return &b
+	}}
+)
+
+// pipe relays bytes between a client and a backend in both directions.
+// A direction that ends cleanly (the sender's FIN) is half-closed, and
+// the other is left to run its course; a direction that fails (resets,
+// timeouts) aborts the other, too. A pipe is idle only once neither
+// direction has moved a byte for idletimeout.
+type pipe struct {
+	src    *Conn
+	dst    net.Conn
+	start  time.Time
+	expiry time.Time // zero if no max lifetime
+	active int64     // unix nanos of the last read or write, either way
+
+	mu      sync.Mutex
+	aborted bool
+
+	legs [2]leg // up, down
+}
+
+// leg is the outcome of one direction of a pipe
+type leg struct {
+	n   int64
+	why string
+}
+
+func newPipe(src *Conn, dst net.Conn) *pipe {
+	p := &pipe{src: src, dst: dst, start: time.Now()}
+	p.active = p.start.UnixNano()
+	if maxlifetime > 0 {
+		p.expiry = p.start.Add(maxlifetime)
+	}
+	return p
+}
+
+// run blocks until both directions are done, and then logs both legs
+func (p *pipe) run(to Target) {
+	if idletimeout <= 0 && !p.expiry.IsZero() {
+		// copies are spliced, and only the lifetime is enforced
+		_ = p.src.SetDeadline(p.expiry)
+		_ = p.dst.SetDeadline(p.expiry)
+	}
+
+	shup, shdown := shaper(p.src, to, up), shaper(p.src, to, down)
+	defer shup.release()
+	defer shdown.release()
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go p.copy(&p.legs[up], p.dst, p.src, shup, wg)
+	go p.copy(&p.legs[down], p.src, p.dst, shdown, wg)
+	wg.Wait()
+
+	u, d := p.legs[up], p.legs[down]
+	log.Printf("relay: %s [src %s (via %s)] <-> [dst %s (via %s)] in %s; up: %d (%s); down: %d (%s)",
+		p.src.ID, p.src.RemoteAddr(), p.src.LocalAddr(), p.dst.RemoteAddr(), p.dst.LocalAddr(),
+		time.Since(p.start).Round(time.Millisecond), u.n, u.why, d.n, d.why)
+}
+
+// copy copies src to dst (shaped by sh, if not nil) and records how
+// many bytes it copied and why it stopped in l.
+func (p *pipe) copy(l *leg, dst, src net.Conn, sh *shaped, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	// Before we unwrap src and/or dst, copy any buffered data.
+	if wc, ok := src.(*Conn); ok && len(wc.Peeked) > 0 {
+		n, err := dst.Write(wc.Peeked)
+		l.n += int64(n)
+		if err != nil {
+			l.why = "peek " + p.reason(err)
+			p.abort()
+			return
+		}
+		wc.Peeked = nil
+	}
+
+	// Unwrap the src and dst from *Conn to *net.TCPConn so Go
+	// 1.11's splice optimization kicks in.
+	src = underlyingConn(src)
+	dst = underlyingConn(dst)
+
+	// shaping forgoes splice
+	var w io.Writer = dst
+	if sh != nil {
+		sh.w = dst
+		w = sh
+	}
+
+	var n int64
+	var err error
+	if idletimeout > 0 {
+		// as do idle timeouts, which need deadlines set per read / write
+		n, err = p.copyIdle(w, dst, src)
+	} else {
+		n, err = io.Copy(w, src)
+	}
+	l.n += n
+
+	if err != nil {
+		l.why = p.reason(err)
+		p.abort()
+		return
+	}
+	l.why = "eof"
+	// pass the FIN on, and let the other direction carry on
+	if err := closeWrite(dst); errors.Is(err, errNoHalfClose) {
+		// dst (say, a conn via socks5) can't be half-closed; the other
+		// direction runs its course regardless
+		l.why = "eof; no half-close"
+	} else if err != nil {
+		l.why = "eof; " + p.reason(err)
+		p.abort()
+	}
+}
+
+// copyIdle is io.Copy but with read and write deadlines that are
+// pushed back on every read and write, in either direction; a read
+// that times out while the other direction is busy is retried.
+func (p *pipe) copyIdle(w io.Writer, dst, src net.Conn) (n int64, err error) {
+	bp := copybufs.Get().(*[]byte)
+	defer copybufs.Put(bp)
+	buf := *bp
+
+	for {
+		if err = p.extend(src.SetReadDeadline); err != nil {
+			return
+		}
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			p.touch()
+			if err = p.extend(dst.SetWriteDeadline); err != nil {
+				return
+			}
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+			if nw < nr {
+				return n, io.ErrShortWrite
+			}
+			p.touch()
+		}
+		if rerr == io.EOF {
+			return n, nil
+		} else if errors.Is(rerr, os.ErrDeadlineExceeded) && !p.idle() {
+			continue
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// touch marks the pipe active as of now
+func (p *pipe) touch() {
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+}
+
+// idle tells whether neither direction has moved a byte for idletimeout,
+// or the pipe is past its expiry, or has been aborted
+func (p *pipe) idle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	last := time.Unix(0, atomic.LoadInt64(&p.active))
+	return p.aborted || now.Sub(last) >= idletimeout || (!p.expiry.IsZero() && !now.Before(p.expiry))
+}
+
+// extend sets a deadline idletimeout from the pipe's last activity (or
+// the expiry, if that's sooner) with set; unless the pipe has been
+// aborted.
+func (p *pipe) extend(set func(time.Time) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.aborted {
+		return errAborted
+	}
+	t := time.Unix(0, atomic.LoadInt64(&p.active)).Add(idletimeout)
+	if !p.expiry.IsZero() && p.expiry.Before(t) {
+		t = p.expiry
+	}
+	return set(t)
+}
+
+// abort unblocks the copy in the other direction, if it's still on
+func (p *pipe) abort() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.aborted {
+		return
+	}
+	p.aborted = true
+	now := time.Now()
+	_ = p.src.SetDeadline(now)
+	_ = p.dst.SetDeadline(now)
+}
+
+// reason describes err, which ended a copy, for the logs
+func (p *pipe) reason(err error) string {
+	p.mu.Lock()
+	aborted := p.aborted
+	p.mu.Unlock()
+
+	switch {
+	case errors.Is(err, errAborted):
+		return "aborted"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		if aborted {
+			return "aborted"
+		} else if !p.expiry.IsZero() && !time.Now().Before(p.expiry) {
+			return "max lifetime"
+		}
+		return "idle"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	}
+	return err.Error()
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the writing side of c, if it can be
+func closeWrite(c net.Conn) error {
+	switch x := c.(type) {
+	case closeWriter:
+		return x.CloseWrite()
+	case *limitedConn:
+		return closeWrite(x.Conn)
+	case *Conn:
+		return closeWrite(x.Conn)
+	}
+	if tc := asTCPConn(c); tc != nil {
+		return tc.CloseWrite()
+	}
+	return errNoHalfClose
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback tcp conn
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// withTimeouts sets idletimeout and maxlifetime for the test's duration
+func withTimeouts(t *testing.T, idle, life time.Duration) {
+	prevIdle, prevLife := idletimeout, maxlifetime
+	idletimeout, maxlifetime = idle, life
+	t.Cleanup(func() { idletimeout, maxlifetime = prevIdle, prevLife })
+}
+
+// relay pipes a client to a backend, and returns the client's end, the
+// backend's end, and the pipe, which is done once done is closed
+func relay(t *testing.T, peeked string) (client, backend *net.TCPConn, p *pipe, done chan struct{}) {
+	t.Helper()
+	client, src := tcpPair(t)
+	dst, backend := tcpPair(t)
+	p = newPipe(&Conn{ID: "t", Peeked: []byte(peeked), Conn: src}, dst)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(Target{Kind: TargetDNS})
+	}()
+	return client, backend, p, done
+}
+
+func wait(t *testing.T, done chan struct{}, d time.Duration) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatalf("pipe not done in %s", d)
+	}
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	for _, idle := range []time.Duration{0, time.Minute} {
+		t.Run(idle.String(), func(t *testing.T) {
+			withTimeouts(t, idle, 0)
+			client, backend, p, done := relay(t, "hi ")
+
+			_, _ = client.Write([]byte("ping"))
+			_ = client.CloseWrite()
+			// the backend sees the client's FIN, and yet can respond
+			got, err := io.ReadAll(backend)
+			if err != nil || string(got) != "hi ping" {
+				t.Fatalf("backend: want %q; got %q (err %v)", "hi ping", got, err)
+			}
+			_, _ = backend.Write([]byte("pong"))
+			_ = backend.CloseWrite()
+			got, err = io.ReadAll(client)
+			if err != nil || string(got) != "pong" {
+				t.Fatalf("client: want %q; got %q (err %v)", "pong", got, err)
+			}
+
+			wait(t, done, 5*time.Second)
+			if u, d := p.legs[up], p.legs[down]; u.n != 7 || u.why != "eof" || d.n != 4 || d.why != "eof" {
+				t.Fatalf("want up 7 (eof), down 4 (eof); got up %d (%s), down %d (%s)", u.n, u.why, d.n, d.why)
+			}
+		})
+	}
+}
+
+func TestPipeIdle(t *testing.T) {
+	withTimeouts(t, 100*time.Millisecond, 0)
+	start := time.Now()
+	_, _, p, done := relay(t, "")
+
+	wait(t, done, 5*time.Second)
+	if took := time.Since(start); took < idletimeout {
+		t.Fatalf("want pipe done once idle for %s; took %s", idletimeout, took)
+	}
+	if u, d := p.legs[up], p.legs[down]; u.why != "idle" && d.why != "idle" {
+		t.Fatalf("want idle; got up %s, down %s", u.why, d.why)
+	}
+}
+
+func TestPipeBusyOneWayIsNotIdle(t *testing.T) {
+	withTimeouts(t, 150*time.Millisecond, 0)
+	client, backend, p, done := relay(t, "")
+
+	// the client sends nothing, while the backend trickles bytes for
+	// longer than idletimeout
+	go func() {
+		for i := 0; i < 10; i++ {
+			_, _ = backend.Write([]byte("x"))
+			time.Sleep(50 * time.Millisecond)
+		}
+		_ = backend.CloseWrite()
+	}()
+	got, err := io.ReadAll(client)
+	if err != nil || len(got) != 10 {
+		t.Fatalf("client: want 10 bytes; got %d (err %v)", len(got), err)
+	}
+
+	wait(t, done, 5*time.Second)
+	if d := p.legs[down]; d.n != 10 || d.why != "eof" {
+		t.Fatalf("want down 10 (eof); got %d (%s)", d.n, d.why)
+	}
+}
+
+func TestPipeAbort(t *testing.T) {
+	for _, idle := range []time.Duration{0, time.Minute} {
+		t.Run(idle.String(), func(t *testing.T) {
+			withTimeouts(t, idle, 0)
+			_, backend, p, done := relay(t, "")
+
+			// a reset, unlike a FIN, cuts the other direction, too
+			_ = backend.SetLinger(0)
+			backend.Close()
+
+			wait(t, done, 5*time.Second)
+			if u, d := p.legs[up], p.legs[down]; u.why != "aborted" || d.why == "eof" {
+				t.Fatalf("want down failed, and up aborted; got up %s, down %s", u.why, d.why)
+			}
+		})
+	}
+}
+
+func TestPipeMaxLifetime(t *testing.T) {
+	for _, idle := range []time.Duration{0, time.Minute} {
+		t.Run(idle.String(), func(t *testing.T) {
+			withTimeouts(t, idle, 100*time.Millisecond)
+			client, _, p, done := relay(t, "")
+
+			// however busy
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(10 * time.Millisecond):
+						_, _ = client.Write([]byte("x"))
+					}
+				}
+			}()
+
+			wait(t, done, 5*time.Second)
+			if u, d := p.legs[up], p.legs[down]; u.why != "max lifetime" && d.why != "max lifetime" {
+				t.Fatalf("want max lifetime; got up %s, down %s", u.why, d.why)
+			}
+		})
+	}
+}
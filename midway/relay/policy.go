@@ -0,0 +1,91 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/celzero/gateway/midway/env"
+)
+
+type rule struct {
+	allow bool
+	match matcher
+	line  string // as-is from the policy file, for logs
+}
+
+// Policy is an ordered list of allow / deny rules; the first
+// rule that matches a conn decides its fate.
+type Policy struct {
+	rules []rule
+}
+
+// LoadPolicy reads rules from the file at path, one per line:
+//
+//	# lines beginning with # are ignored
+//	deny  cidr:10.0.0.0/8
+//	allow host:example.com port:443
+//	allow suffix:example.org
+//	deny  regex:^ads?\.
+//	deny  *
+//
+// All conditions on a line must match for the rule to apply;
+// see parseMatcher for the kinds of conditions. A conn that
+// matches no rule is allowed. An empty path is an empty policy.
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{}
+	if len(path) <= 0 {
+		return p, nil
+	}
+
+	lines, err := env.ReadConf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range lines {
+		var allow bool
+		switch strings.ToLower(l.Toks[0]) {
+		case "allow":
+			allow = true
+		case "deny":
+			allow = false
+		default:
+			return nil, fmt.Errorf("policy: %s:%d: want allow or deny, got %q", path, l.N, l.Toks[0])
+		}
+		m, err := parseMatchers(l.Toks[1:])
+		if err != nil {
+			return nil, fmt.Errorf("policy: %s:%d: %w", path, l.N, err)
+		}
+		p.rules = append(p.rules, rule{allow: allow, match: m, line: l.Raw})
+	}
+
+	log.Printf("policy: %d rules from %s", len(p.rules), path)
+	return p, nil
+}
+
+// Allow reports whether c may be relayed, and the rule that decided
+// so, if any.
+func (p *Policy) Allow(c *Conn) (bool, string) {
+	if p == nil {
+		return true, ""
+	}
+	for _, r := range p.rules {
+		if r.match(c) {
+			return r.allow, r.line
+		}
+	}
+	return true, ""
+}
+
+// denyAll is the policy in effect when the policy file is unusable;
+// better to relay nothing than to relay everything.
+func denyAll() *Policy {
+	all, _ := parseMatcher("*")
+	return &Policy{rules: []rule{{allow: false, match: all, line: "deny * (bad policy)"}}}
+}
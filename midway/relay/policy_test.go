@@ -0,0 +1,79 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConf(t *testing.T, conf string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "conf")
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPolicy(t *testing.T) {
+	p, err := LoadPolicy(writeConf(t, `
+# first match wins
+deny  cidr:10.0.0.0/8
+allow host:example.com port:443
+deny  suffix:example.com
+allow suffix:example.org
+deny  *
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		c    *Conn
+		want bool
+		rule string
+	}{
+		{&Conn{HostName: "example.com", Port: "443", Conn: from("10.0.0.1")}, false, "deny  cidr:10.0.0.0/8"},
+		{&Conn{HostName: "example.com", Port: "443", Conn: from("192.0.2.1")}, true, "allow host:example.com port:443"},
+		{&Conn{HostName: "example.com", Port: "80", Conn: from("192.0.2.1")}, false, "deny  suffix:example.com"},
+		{&Conn{HostName: "www.example.org", Port: "80", Conn: from("192.0.2.1")}, true, "allow suffix:example.org"},
+		{&Conn{HostName: "example.net", Port: "443", Conn: from("192.0.2.1")}, false, "deny  *"},
+	}
+	for _, tc := range tests {
+		ok, rule := p.Allow(tc.c)
+		if ok != tc.want || rule != tc.rule {
+			t.Errorf("%s:%s: want %t by %q; got %t by %q", tc.c.HostName, tc.c.Port, tc.want, tc.rule, ok, rule)
+		}
+	}
+
+	// sans rules, or a policy, all is allowed
+	empty, err := LoadPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var none *Policy
+	for _, p := range []*Policy{empty, none} {
+		if ok, _ := p.Allow(&Conn{HostName: "example.net"}); !ok {
+			t.Error("want conns allowed sans rules")
+		}
+	}
+	if ok, _ := denyAll().Allow(&Conn{}); ok {
+		t.Error("want conns denied by denyAll")
+	}
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	for _, conf := range []string{
+		"permit host:example.com\n",
+		"allow\n",
+		"deny nope:x\n",
+	} {
+		if _, err := LoadPolicy(writeConf(t, conf)); err == nil {
+			t.Errorf("%q: want err", conf)
+		}
+	}
+}
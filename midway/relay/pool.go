@@ -0,0 +1,301 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type strategy string
+
+const (
+	roundRobin strategy = "rr"
+	leastConns strategy = "leastconn"
+	clientHash strategy = "hash" // rendezvous hash on client ip
+)
+
+var (
+	errNoPool    = errors.New("relay: no such pool")
+	errNoMembers = errors.New("relay: no healthy pool members")
+)
+
+type member struct {
+	addr   string // host:port
+	active int32  // open conns
+	down   int32  // 1 if ejected
+	fails  int    // consecutive failed probes (or dials); guarded by pool.mu
+	oks    int    // consecutive passed probes; guarded by pool.mu
+}
+
+func (m *member) healthy() bool { return atomic.LoadInt32(&m.down) == 0 }
+
+type pool struct {
+	name     string
+	strategy strategy
+	members  []*member
+	next     uint32 // round-robin cursor
+
+	check    string // tcp, tls, or none
+	interval time.Duration
+	fall     int // consecutive failures to eject a member
+	rise     int // consecutive successes to reinstate a member
+
+	// the proxy routes reach members via, which probes go via, too
+	via *url.URL
+
+	mu sync.Mutex // guards member fails / oks
+}
+
+// parsePool parses a pool definition (sans the leading "pool"):
+//
+//	<name> <rr|leastconn|hash> <host:port>... [check=tcp|tls|none]
+//	    [interval=10s] [fall=2] [rise=2]
+//
+// Members that fail fall probes, or dials, in a row are ejected; and
+// reinstated once they pass rise probes in a row, or, with check=none,
+// after interval.
+func parsePool(toks []string) (*pool, error) {
+	if len(toks) < 3 {
+		return nil, fmt.Errorf("want: pool <name> <strategy> <host:port>...")
+	}
+	p := &pool{
+		name:     toks[0],
+		strategy: strategy(strings.ToLower(toks[1])),
+		check:    "tcp",
+		interval: 10 * time.Second,
+		fall:     2,
+		rise:     2,
+	}
+	switch p.strategy {
+	case roundRobin, leastConns, clientHash:
+	default:
+		return nil, fmt.Errorf("pool %s: unknown strategy %q", p.name, toks[1])
+	}
+
+	for _, tok := range toks[2:] {
+		if k, v, ok := strings.Cut(tok, "="); ok {
+			var err error
+			switch k {
+			case "check":
+				if v != "tcp" && v != "tls" && v != "none" {
+					err = fmt.Errorf("want tcp, tls, or none")
+				}
+				p.check = v
+			case "interval":
+				p.interval, err = time.ParseDuration(v)
+			case "fall":
+				p.fall, err = strconv.Atoi(v)
+			case "rise":
+				p.rise, err = strconv.Atoi(v)
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("pool %s: %s: %w", p.name, tok, err)
+			}
+			continue
+		}
+		if _, _, err := net.SplitHostPort(tok); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", p.name, err)
+		}
+		p.members = append(p.members, &member{addr: tok})
+	}
+
+	if len(p.members) <= 0 {
+		return nil, fmt.Errorf("pool %s: no members", p.name)
+	}
+	if p.interval <= 0 || p.fall <= 0 || p.rise <= 0 {
+		return nil, fmt.Errorf("pool %s: interval, fall, rise must be > 0", p.name)
+	}
+	return p, nil
+}
+
+// pick returns healthy members of p in the order they must be tried
+// for conn c; the first is as per the pool's strategy.
+func (p *pool) pick(c *Conn) []*member {
+	up := make([]*member, 0, len(p.members))
+	for _, m := range p.members {
+		if m.healthy() {
+			up = append(up, m)
+		}
+	}
+	if len(up) <= 1 {
+		return up
+	}
+
+	switch p.strategy {
+	case leastConns:
+		min := 0
+		for i := range up {
+			if atomic.LoadInt32(&up[i].active) < atomic.LoadInt32(&up[min].active) {
+				min = i
+			}
+		}
+		up[0], up[min] = up[min], up[0]
+	case clientHash:
+		ip, _ := clientIP(c)
+		key := ip.String()
+		max, maxw := 0, uint64(0)
+		for i := range up {
+			if w := hrw(key, up[i].addr); w > maxw {
+				max, maxw = i, w
+			}
+		}
+		up[0], up[max] = up[max], up[0]
+	default:
+		n := atomic.AddUint32(&p.next, 1)
+		i := int(n % uint32(len(up)))
+		rot := make([]*member, 0, len(up))
+		rot = append(rot, up[i:]...)
+		up = append(rot, up[:i]...)
+	}
+	return up
+}
+
+// dial connects to the first member of p that answers (directly, or
+// via, if not nil), and returns a fn to be called once the conn is
+// done with.
+func (p *pool) dial(c *Conn, via dialFunc) (net.Conn, func(), error) {
+	tries := p.pick(c)
+	if len(tries) <= 0 {
+		return nil, nil, fmt.Errorf("%w: %s", errNoMembers, p.name)
+	}
+
+	var errs []string
+	for _, m := range tries {
+		ctx, cancel := context.WithTimeout(context.Background(), conntimeout)
+		dst, err := dialContext(ctx, via, c.Typ, m.addr, true)
+		cancel()
+		if err != nil {
+			errs = append(errs, err.Error())
+			p.report(m, false)
+			continue
+		}
+		p.dialed(m)
+		atomic.AddInt32(&m.active, 1)
+		return dst, func() { atomic.AddInt32(&m.active, -1) }, nil
+	}
+	return nil, nil, fmt.Errorf("pool %s: %s", p.name, strings.Join(errs, "; "))
+}
+
+// report records the outcome of a probe (or a dial) to m, and
+// ejects or reinstates m as needed.
+func (p *pool) report(m *member, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ok {
+		m.fails = 0
+		m.oks++
+		if !m.healthy() && m.oks >= p.rise {
+			atomic.StoreInt32(&m.down, 0)
+			log.Printf("pool: %s: reinstate %s", p.name, m.addr)
+		}
+	} else {
+		m.oks = 0
+		m.fails++
+		if m.healthy() && m.fails >= p.fall {
+			atomic.StoreInt32(&m.down, 1)
+			log.Printf("pool: %s: eject %s", p.name, m.addr)
+			if p.check == "none" {
+				// no probes to reinstate m; so, give it another go
+				// once it has cooled off
+				time.AfterFunc(p.interval, func() { p.reinstate(m) })
+			}
+		}
+	}
+}
+
+// dialed notes a conn to m, which ends its run of failures, if any
+func (p *pool) dialed(m *member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.fails = 0
+}
+
+func (p *pool) reinstate(m *member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m.fails, m.oks = 0, 0
+	if !m.healthy() {
+		atomic.StoreInt32(&m.down, 0)
+		log.Printf("pool: %s: reinstate %s after %s", p.name, m.addr, p.interval)
+	}
+}
+
+// healthcheck probes all members of p every interval, until stop is
+// closed.
+func (p *pool) healthcheck(stop <-chan struct{}) {
+	if p.check == "none" {
+		return
+	}
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		for _, m := range p.members {
+			go func(m *member) {
+				p.report(m, p.probe(m))
+			}(m)
+		}
+	}
+}
+
+// probe tells whether m can be connected to, via the pool's proxy, if
+// any; and with check=tls, whether it speaks tls.
+func (p *pool) probe(m *member) bool {
+	var via dialFunc
+	if p.via != nil {
+		var err error
+		if via, err = viaDialer(p.via); err != nil {
+			return false
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conntimeout)
+	defer cancel()
+	c, err := dialContext(ctx, via, "tcp", m.addr, true)
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+
+	if p.check == "tls" {
+		host, _, _ := net.SplitHostPort(m.addr)
+		_ = c.SetDeadline(time.Now().Add(conntimeout))
+		// only checks if the member speaks tls; not if its cert is valid
+		tc := tls.Client(c, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// hrw is the rendezvous weight of addr for key
+func hrw(key, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	return h.Sum64()
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustPool(t *testing.T, def string) *pool {
+	t.Helper()
+	p, err := parsePool(strings.Fields(def))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParsePool(t *testing.T) {
+	p := mustPool(t, "origins leastconn 10.0.0.7:443 [2001:db8::7]:443 check=tls interval=5s fall=3 rise=1")
+	if p.name != "origins" || p.strategy != leastConns || len(p.members) != 2 || p.members[1].addr != "[2001:db8::7]:443" {
+		t.Fatalf("bad pool %+v", p)
+	}
+	if p.check != "tls" || p.interval != 5*time.Second || p.fall != 3 || p.rise != 1 {
+		t.Fatalf("bad opts %+v", p)
+	}
+
+	def := mustPool(t, "origins RR a.example:443")
+	if def.strategy != roundRobin || def.check != "tcp" || def.interval != 10*time.Second || def.fall != 2 || def.rise != 2 {
+		t.Fatalf("bad defaults %+v", def)
+	}
+
+	for _, def := range []string{
+		"origins",
+		"origins rr",
+		"origins random 10.0.0.7:443",
+		"origins rr 10.0.0.7",
+		"origins rr check=tcp",
+		"origins rr 10.0.0.7:443 check=http",
+		"origins rr 10.0.0.7:443 interval=soon",
+		"origins rr 10.0.0.7:443 interval=0s",
+		"origins rr 10.0.0.7:443 fall=0",
+		"origins rr 10.0.0.7:443 rise=x",
+		"origins rr 10.0.0.7:443 weight=2",
+	} {
+		if _, err := parsePool(strings.Fields(def)); err == nil {
+			t.Errorf("%q: want err", def)
+		}
+	}
+}
+
+func addrs(ms []*member) string {
+	var s []string
+	for _, m := range ms {
+		s = append(s, m.addr)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestPoolPick(t *testing.T) {
+	c := &Conn{Conn: from("192.0.2.1")}
+
+	rr := mustPool(t, "p rr a:1 b:1 c:1")
+	var firsts []string
+	for i := 0; i < 3; i++ {
+		got := rr.pick(c)
+		if len(got) != 3 {
+			t.Fatalf("want all members to try; got %s", addrs(got))
+		}
+		firsts = append(firsts, got[0].addr)
+	}
+	if strings.Join(firsts, " ") != "b:1 c:1 a:1" {
+		t.Fatalf("want members in turn; got %v", firsts)
+	}
+
+	lc := mustPool(t, "p leastconn a:1 b:1 c:1")
+	lc.members[0].active, lc.members[1].active, lc.members[2].active = 3, 1, 2
+	if got := lc.pick(c); got[0].addr != "b:1" || len(got) != 3 {
+		t.Fatalf("want the least busy first; got %s", addrs(got))
+	}
+
+	h := mustPool(t, "p hash a:1 b:1 c:1 d:1")
+	first := h.pick(c)[0]
+	for i := 0; i < 10; i++ {
+		if got := h.pick(c)[0]; got != first {
+			t.Fatalf("want a client's conns to the same member; got %s and %s", first.addr, got.addr)
+		}
+	}
+	// other members stay put when one is down
+	var other *member
+	for _, m := range h.members {
+		if m != first {
+			other = m
+			break
+		}
+	}
+	other.down = 1
+	if got := h.pick(c)[0]; got != first {
+		t.Fatalf("want the client's member as-is; got %s", got.addr)
+	}
+	// and clients of the down member move elsewhere
+	first.down = 1
+	if got := h.pick(c); len(got) != 2 || got[0] == first {
+		t.Fatalf("want healthy members alone; got %s", addrs(got))
+	}
+}
+
+func TestPoolEjectReinstate(t *testing.T) {
+	p := mustPool(t, "p rr a:1 b:1 fall=2 rise=2")
+	a := p.members[0]
+
+	p.report(a, false)
+	if !a.healthy() {
+		t.Fatal("want a member up until fall fails in a row")
+	}
+	p.dialed(a) // a conn ends the run
+	p.report(a, false)
+	if !a.healthy() {
+		t.Fatal("want fails reset by dials")
+	}
+	p.report(a, false)
+	if a.healthy() {
+		t.Fatal("want a member ejected once fall fails in a row")
+	}
+	if got := p.pick(&Conn{}); len(got) != 1 || got[0] == a {
+		t.Fatalf("want ejected members skipped; got %s", addrs(got))
+	}
+
+	p.report(a, true)
+	if a.healthy() {
+		t.Fatal("want a member down until rise oks in a row")
+	}
+	p.report(a, true)
+	if !a.healthy() {
+		t.Fatal("want a member reinstated once rise oks in a row")
+	}
+}
+
+func TestPoolReinstateSansChecks(t *testing.T) {
+	p := mustPool(t, "p rr a:1 check=none interval=50ms fall=1")
+	a := p.members[0]
+	p.report(a, false)
+	if a.healthy() {
+		t.Fatal("want a member ejected")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !a.healthy() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.healthy() {
+		t.Fatal("want a member reinstated once it cools off")
+	}
+}
+
+func TestPoolDial(t *testing.T) {
+	up := listen(t, echo)
+	// a port no one listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	p := mustPool(t, "p leastconn "+down+" "+up+" fall=1")
+	dst, done, err := p.dial(&Conn{Typ: "tcp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if p.members[0].healthy() {
+		t.Fatal("want members that fail to dial ejected")
+	}
+	if got := p.members[1].active; got != 1 {
+		t.Fatalf("want 1 active conn; got %d", got)
+	}
+	done()
+	if got := p.members[1].active; got != 0 {
+		t.Fatalf("want no active conns once done; got %d", got)
+	}
+
+	p.members[1].down = 1
+	if _, _, err := p.dial(&Conn{Typ: "tcp"}, nil); err == nil {
+		t.Fatal("want an err sans healthy members")
+	}
+}
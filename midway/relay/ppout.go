@@ -0,0 +1,75 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+var (
+	connprefix = bootid()
+	conncount  uint64
+)
+
+// nextConnID is unique to a conn for the lifetime of this process,
+// and very likely unique across processes, too.
+func nextConnID() string {
+	return fmt.Sprintf("%08x%08x", connprefix, atomic.AddUint64(&conncount, 1))
+}
+
+func bootid() uint32 {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// writeProxyHeader sends a PROXY protocol header of version v to w
+// with the client addr of c, and for v2, the host/sni and the id of c
+// as PP2_TYPE_AUTHORITY and PP2_TYPE_UNIQUE_ID TLVs.
+func writeProxyHeader(w io.Writer, v byte, c *Conn) error {
+	src, dst := ppAddrs(c.RemoteAddr(), c.LocalAddr())
+	h := proxyproto.HeaderProxyFromAddrs(v, src, dst)
+
+	if v == 2 {
+		var tlvs []proxyproto.TLV
+		if len(c.HostName) > 0 && len(c.HostName) <= 255 {
+			tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte(c.HostName)})
+		}
+		// rfc: unique-id must not be longer than 128 bytes
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2_TYPE_UNIQUE_ID, Value: []byte(c.ID)})
+		if err := h.SetTLVs(tlvs); err != nil {
+			return err
+		}
+	}
+
+	_, err := h.WriteTo(w)
+	return err
+}
+
+// ppAddrs returns src and dst as tcp addrs of the same family, as
+// required by the PROXY protocol. If they differ, the client (src) addr
+// is what matters, and so dst is replaced by an unspecified addr.
+func ppAddrs(src, dst net.Addr) (net.Addr, net.Addr) {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		return src, dst
+	}
+	if (s.IP.To4() == nil) == (d.IP.To4() == nil) {
+		return s, d
+	}
+	if s.IP.To4() != nil {
+		return s, &net.TCPAddr{IP: net.IPv4zero, Port: d.Port}
+	}
+	return s, &net.TCPAddr{IP: net.IPv6unspecified, Port: d.Port}
+}
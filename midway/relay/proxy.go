@@ -8,8 +8,8 @@ package relay
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/netip"
@@ -20,20 +20,44 @@ import (
 	"github.com/celzero/gateway/midway/env"
 )
 
+var errDenied = errors.New("relay: denied")
+
+// peekers are readers conns are sniffed with; big enough to peek
+// ClientHellos that span many records
+var peekers = sync.Pool{New: func() any {
+	return bufio.NewReaderSize(nil, helloBufSize)
+}}
+
 var (
 	flyappname     = env.FlyAppName()
 	flyurl         = flyappname + ".fly.dev"
 	noproxytimeout = env.NoProxyTimeoutSec()
 	dontproxy      = env.ProxyDisabled()
 	conntimeout    = env.ConnTimeoutSec()
+	policy         = mustPolicy(env.RelayPolicy())
+)
+
+// ech states of tls conns
+const (
+	ECHNone  = ""      // no ech
+	ECHOuter = "outer" // ech, but not decrypted; routed on the public name
+	ECHInner = "inner" // ech, decrypted; routed on the inner hello's sni
 )
 
 type Conn struct {
+	ID       string
 	Typ      string
+	Proto    string       // as sniffed; see sniff
+	Hello    *ClientHello // if proto is tls; the inner hello, if ech
+	ECH      string       // if proto is tls; see ECHInner, ECHOuter
 	HostName string
 	Port     string
 	Peeked   []byte
 	net.Conn
+
+	// ack, if set, tells clients of explicit proxies (http, socks)
+	// whether their conn is being relayed (nil) or not (err)
+	ack func(err error)
 }
 
 func (c *Conn) Read(p []byte) (int, error) {
@@ -65,24 +89,56 @@ func NewProxyConn(c net.Conn) *Conn {
 	// proxy src:local-ip4 to dst:remote-ip4 / src:local-ip6 to dst:remote-ip6
 	typ, _ := tcp4or6(c.LocalAddr())
 
-	br := bufio.NewReader(c)
+	br := peekers.Get().(*bufio.Reader)
+	br.Reset(c)
+	defer func() {
+		br.Reset(nil)
+		peekers.Put(br)
+	}()
 
-	httpHostName := httpHostHeader(br)
-	sniServerName := clientHelloServerName(br)
+	_ = c.SetReadDeadline(time.Now().Add(conntimeout))
+	proto := sniff(br)
 
-	var upstream string
-	if len(httpHostName) > 0 {
-		upstream = httpHostName
-	} else if len(sniServerName) > 0 {
-		upstream = sniServerName
-	} else {
-		fmt.Printf("host/sni missing %s %s\n", c.LocalAddr(), c.RemoteAddr())
+	var upstream, ech string
+	var hello *ClientHello
+	var inner []byte // records of the inner hello, for those of the outer
+	var outerlen int
+	switch proto {
+	case ProtoHTTP:
+		var reqport string
+		if upstream, reqport = httpHostHeader(br); len(reqport) > 0 {
+			port = reqport
+		}
+	case ProtoTLS:
+		if hello = readClientHello(br); hello != nil {
+			upstream = hello.ServerName
+		}
+		if hello != nil && hello.ECH != nil {
+			ech = ECHOuter
+			if h, recs, n, err := unwrapECH(br, hello); err == nil {
+				ech, hello, upstream = ECHInner, h, h.ServerName
+				inner, outerlen = recs, n
+			} else if echkey != nil {
+				log.Printf("relay: ech %s from %s; route on public name %s", err, c.RemoteAddr(), upstream)
+			}
+		}
 	}
+	_ = c.SetReadDeadline(time.Time{})
 
-	peeked, _ := br.Peek(br.Buffered())
+	if len(upstream) <= 0 {
+		fmt.Printf("host/sni missing %s %s; proto: %q\n", c.LocalAddr(), c.RemoteAddr(), proto)
+	}
+
+	// copied, as br is reused
+	buffered, _ := br.Peek(br.Buffered())
+	peeked := append(inner, buffered[outerlen:]...)
 
 	return &Conn{
+		ID:       nextConnID(),
 		Typ:      typ,      // tcp or tcp4 or tcp6
+		Proto:    proto,    // may be empty
+		Hello:    hello,    // may be nil
+		ECH:      ech,      // may be empty
 		HostName: upstream, // may be nil
 		Port:     port,
 		Peeked:   peeked, // len may be 0
@@ -93,107 +149,120 @@ func NewProxyConn(c net.Conn) *Conn {
 func (src *Conn) Forward() {
 	defer src.Close()
 
+	if !streams.add(src) {
+		log.Printf("relay: %s draining; drop conn from %s", src.ID, src.RemoteAddr())
+		return
+	}
+	defer streams.remove(src)
+
 	// TODO: discard health-checks conns appear from fly-edge w.x.y.z
 	// 19:49 [info] host/sni missing 172.19.0.170:443 103.x.y.z:38862
 	// 20:07 [info] host/sni missing 172.19.0.170:80 w.254.y.z:49008
 	// 20:19 [info] host/sni missing 172.19.0.170:443 w.x.161.z:42676
 	// 20:37 [info] host/sni missing 172.19.0.170:80 w.x.y.146:52548
-	if src.disallow() {
-		time.Sleep(noproxytimeout)
+	to := router.Load().Route(src)
+
+	if src.disallow(to) {
+		if src.ack != nil {
+			src.ack(errDenied)
+			return
+		}
+		streams.tarpit(noproxytimeout)
 		return
 	}
 
-	log.Printf("relay: %s from %s => %s via %s", src.Typ, src.RemoteAddr(), src.HostName, src.LocalAddr())
-	dst, err := net.DialTimeout(src.Typ, net.JoinHostPort((src.HostName), src.Port), conntimeout)
-	if err != nil {
+	log.Printf("relay: %s %s %s from %s => %s (%s) via %s", src.ID, src.Typ, src.Proto, src.RemoteAddr(), src.HostName, to, src.LocalAddr())
+	if h := src.Hello; h != nil {
+		log.Printf("relay: %s hello: ech %q sni %q alpn %v vers %x ciphers %d exts %d groups %x shares %x; ja3 %s ja4 %s",
+			src.ID, src.ECH, h.ServerName, h.ALPN, h.SupportedVersions, len(h.CipherSuites), len(h.Extensions),
+			h.SupportedGroups, h.KeyShares, h.JA3(), h.JA4())
+	}
+	dst, done, err := to.dial(src)
+	if errors.Is(err, errDisallowedIPs) {
+		log.Print("relay: drop conn; ", err)
+		if src.ack != nil {
+			src.ack(errDenied)
+			return
+		}
+		streams.tarpit(noproxytimeout)
+		return
+	} else if err != nil {
 		log.Printf("relay: dial timeout err %v\n", err)
+		if src.ack != nil {
+			src.ack(err)
+		}
 		return
 	}
 
+	defer done()
 	defer dst.Close()
 
-	if src.validroute(dst) {
-		log.Print("relay: drop conn to ", dst.RemoteAddr().String())
-		time.Sleep(noproxytimeout)
-		return
+	log.Printf("relay: %s connected to %s at %s over %s", src.ID, src.HostName, dst.RemoteAddr(), family(dst))
+
+	if to.ProxyProto > 0 {
+		if err := writeProxyHeader(dst, to.ProxyProto, src); err != nil {
+			log.Printf("relay: %s proxy-proto v%d err %v", src.ID, to.ProxyProto, err)
+			return
+		}
+	}
+
+	if src.ECH == ECHInner {
+		if dst, err = sendInner(src, dst); err != nil {
+			log.Printf("relay: %s ech to %s; err %v", src.ID, src.HostName, err)
+			_, _ = src.Write(alertHandshakeFailure)
+			return
+		}
+	}
+
+	if src.ack != nil {
+		src.ack(nil)
 	}
 
-	pwg := &sync.WaitGroup{}
-	pwg.Add(2)
-	go proxyCopy("relay: download", src, dst, pwg)
-	go proxyCopy("relay: upload", dst, src, pwg)
-	pwg.Wait()
+	newPipe(src, dst).run(to)
 }
 
-func (c *Conn) disallow() bool {
+func (c *Conn) disallow(to Target) bool {
 	if dontproxy {
 		return true
 	}
 	dsturl := c.HostName
 
-	if len(dsturl) <= 0 {
-		// discard conn without host/sni
+	if len(dsturl) <= 0 && (len(c.Proto) <= 0 || !to.trusted()) {
+		// discard conn without host/sni, unless its protocol
+		// is routed to a backend of its own
 		return true
 	} else if len(flyappname) > 0 && strings.Contains(dsturl, flyurl) {
 		// discard conn to this host
 		return true
-	}
-	return false // can proxy
-}
-
-func (c *Conn) validroute(to net.Conn) bool {
-	ipportaddr, err := netip.ParseAddrPort(to.RemoteAddr().String())
-	if err != nil {
-		log.Println("disallow err: ", err)
+	} else if ok, why := policy.Allow(c); !ok {
+		log.Printf("relay: deny %s from %s; rule: %s", dsturl, c.RemoteAddr(), why)
 		return true
-	}
-
-	ipaddr := ipportaddr.Addr()
-	if !ipaddr.IsValid() ||
-		ipaddr.IsPrivate() ||
-		ipaddr.IsUnspecified() ||
-		ipaddr.IsLoopback() ||
-		ipaddr.IsMulticast() ||
-		ipaddr.IsLinkLocalUnicast() ||
-		ipaddr.IsLinkLocalMulticast() {
-		log.Print("relay: conn remoting lo/mc/priv/invalid/unspecified ip:", ipaddr)
+	} else if c.ack != nil && len(why) <= 0 && !webPort(c.Port) {
+		// clients of explicit proxies may reach ports other than 80 and
+		// 443 only as allowed by a rule, and not by default
+		log.Printf("relay: deny %s:%s from %s; no rule allows the port", dsturl, c.Port, c.RemoteAddr())
 		return true
 	}
-	return false
+	return false // can proxy
 }
 
-// TODO: admission control with tc / htb
-func proxyCopy(label string, dst, src net.Conn, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	// Before we unwrap src and/or dst, copy any buffered data.
-	if wc, ok := src.(*Conn); ok && len(wc.Peeked) > 0 {
-		if _, err := dst.Write(wc.Peeked); err != nil {
-			log.Print(label, " peek ", err)
-			return
-		}
-		wc.Peeked = nil
-	}
-
-	// Unwrap the src and dst from *Conn to *net.TCPConn so Go
-	// 1.11's splice optimization kicks in.
-	src = underlyingConn(src)
-	dst = underlyingConn(dst)
+func webPort(port string) bool {
+	return port == "80" || port == "443"
+}
 
-	if n, err := io.Copy(dst, src); err == nil {
-		from := src.RemoteAddr()
-		to := dst.RemoteAddr()
-		leg := src.LocalAddr()
-		returnleg := dst.LocalAddr()
-		log.Printf("%s; [src %s (via %s)] -> [dst %s via (%s)]; tx: %d", label, from, leg, to, returnleg, n)
+func mustPolicy(path string) *Policy {
+	if p, err := LoadPolicy(path); err == nil {
+		return p
 	} else {
-		log.Print(label, " copy ", err)
+		log.Print("relay: deny all; ", err)
+		return denyAll()
 	}
 }
 
 // always "tcp" for now, because for web properties that are ipv4-only
 // cause connect-timeouts from incoming ipv6 connections. Instead of
-// specifically returning "tcp6", we now let it be "tcp".
+// specifically returning "tcp6", we now let it be "tcp", and have
+// dialHostPort race ip6 and ip4 addrs of the backend (happy eyeballs).
 func tcp4or6(a net.Addr) (string, error) {
 	if addrport, err := netip.ParseAddrPort(a.String()); err == nil {
 		if addrport.Addr().Is6() || addrport.Addr().Is4In6() {
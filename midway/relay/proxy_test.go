@@ -0,0 +1,44 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// peekConn is a net.Conn that reads from r, and writes nowhere
+type peekConn struct {
+	net.Conn // nil; unused
+	r        *bytes.Reader
+}
+
+var (
+	benchLocal  = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+	benchRemote = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}
+)
+
+func (c *peekConn) Read(p []byte) (int, error)      { return c.r.Read(p) }
+func (c *peekConn) LocalAddr() net.Addr             { return benchLocal }
+func (c *peekConn) RemoteAddr() net.Addr            { return benchRemote }
+func (c *peekConn) SetReadDeadline(time.Time) error { return nil }
+
+func BenchmarkNewProxyConn(b *testing.B) {
+	in := fragment(helloMsg(b, "bench.example.com"))
+	c := &peekConn{r: bytes.NewReader(in)}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(in)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.r.Reset(in)
+		pc := NewProxyConn(c)
+		if pc == nil || pc.HostName != "bench.example.com" || len(pc.Peeked) != len(in) {
+			b.Fatal("bad conn")
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/celzero/gateway/midway/env"
+)
+
+type TargetKind string
+
+const (
+	// dial host/sni of the conn as resolved over dns, as-is
+	TargetDNS TargetKind = "dns"
+	// dial a fixed ip:port
+	TargetAddr TargetKind = "addr"
+	// dial a different hostname, on the same or a different port
+	TargetHost TargetKind = "host"
+	// dial one of the healthy members of a named pool
+	TargetPool TargetKind = "pool"
+)
+
+// Target is the backend a relayed conn is forwarded to.
+type Target struct {
+	Kind TargetKind
+	// addr: "ip:port"; host: "name" or "name:port"; pool: "name";
+	// dns: empty
+	Dst string
+	// PROXY protocol version (1 or 2) to send to the backend; 0 for none
+	ProxyProto byte
+	// upstream socks5 or http proxy to reach the backend via; or nil
+	Via *url.URL
+	// shaping (priority) class; "default" if empty
+	Class string
+
+	pool  *pool  // named by Dst, if a pool target
+	class *class // named by Class; or nil if unshaped
+}
+
+// Router maps a sniffed conn to a backend.
+type Router interface {
+	Route(c *Conn) Target
+}
+
+// dnsRouter is the router in effect when no routes are configured
+type dnsRouter struct{}
+
+func (dnsRouter) Route(*Conn) Target { return Target{Kind: TargetDNS} }
+
+// routing is the router in use, along with what it runs; see UseRouter
+type routing struct {
+	Router
+	stop chan struct{} // closed once replaced
+}
+
+// router routes conns; swapped whole, along with the pools and classes
+// of its routes, by UseRouter
+var router atomic.Pointer[routing]
+
+func init() {
+	UseRouter(mustRouter(env.RelayRoutes()))
+}
+
+// UseRouter replaces the router in use, which is at first loaded from
+// the file set in env RELAY_ROUTES; and stops health checks (and such)
+// of the one it replaces. Conns already routed are left be.
+func UseRouter(r Router) {
+	if r == nil {
+		r = dnsRouter{}
+	}
+	next := &routing{Router: r, stop: make(chan struct{})}
+	if sr, ok := r.(*staticRouter); ok {
+		sr.run(next.stop)
+	}
+	if prev := router.Swap(next); prev != nil {
+		close(prev.stop)
+	}
+}
+
+// hostport is the addr to dial for target t on behalf of c
+func (t Target) hostport(c *Conn) string {
+	switch t.Kind {
+	case TargetAddr:
+		return t.Dst
+	case TargetHost:
+		if _, _, err := net.SplitHostPort(t.Dst); err == nil {
+			return t.Dst
+		}
+		return net.JoinHostPort(t.Dst, c.Port)
+	default:
+		return net.JoinHostPort(c.HostName, c.Port)
+	}
+}
+
+// dial connects to target t on behalf of c, and returns a fn to be
+// called once the conn is done with.
+func (t Target) dial(c *Conn) (net.Conn, func(), error) {
+	var via dialFunc
+	if t.Via != nil {
+		var err error
+		if via, err = viaDialer(t.Via); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if t.Kind == TargetPool {
+		if t.pool == nil {
+			return nil, nil, fmt.Errorf("%w: %s", errNoPool, t.Dst)
+		}
+		return t.pool.dial(c, via)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conntimeout)
+	defer cancel()
+
+	// names of dns targets are sent to socks5h proxies, which then
+	// vet the ips they connect to, as midway can't
+	trusted := t.trusted() || (t.Via != nil && t.Via.Scheme == "socks5h")
+	dst, err := dialContext(ctx, via, c.Typ, t.hostport(c), trusted)
+	return dst, func() {}, err
+}
+
+// trusted targets are set up by the operator, and may dial into
+// private networks; untrusted targets are named by the client.
+func (t Target) trusted() bool {
+	return t.Kind != TargetDNS
+}
+
+func (t Target) String() string {
+	s := string(t.Kind)
+	if len(t.Dst) > 0 {
+		s += ":" + t.Dst
+	}
+	if t.Via != nil {
+		s += " via " + t.Via.Redacted()
+	}
+	if len(t.Class) > 0 {
+		s += " as " + t.Class
+	}
+	return s
+}
+
+type route struct {
+	match  matcher
+	target Target
+	line   string
+}
+
+// staticRouter picks the target of the first route that matches
+type staticRouter struct {
+	routes   []route
+	fallback Target // of conns that match no route
+	pools    map[string]*pool
+	classes  map[string]*class
+}
+
+// LoadRoutes reads routes and pools from the file at path, one per line:
+//
+//	# pool <name> <strategy> <host:port>... [opts]; see parsePool
+//	pool origins rr 10.0.0.7:443 10.0.0.8:443 check=tls
+//	# class <name> [opts]; see parseClass
+//	class bulk prio=6 conn=8mbit client=16mbit total=100mbit
+//	# conditions => target
+//	host:api.example.com     => addr:10.0.0.5:8443
+//	suffix:example.org       => host:origin.example.net
+//	wild:*.cdn.example.com   => host:cdn.example.net:8443
+//	host:www.example.com     => pool:origins pp=v2
+//	suffix:dl.example.com    => dns class=bulk
+//	*                        => dns
+//
+// Conditions are as in a policy (see parseMatcher), and options
+// that may follow the target are as in parseOpts. Conns that
+// match no route are sent to their own host/sni over dns, which is
+// also what happens when path is empty.
+func LoadRoutes(path string) (Router, error) {
+	if len(path) <= 0 {
+		return dnsRouter{}, nil
+	}
+
+	lines, err := env.ReadConf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// pools and classes are defined before routes refer to them
+	defs := map[string]*pool{}
+	clss := map[string]*class{}
+	for _, l := range lines {
+		switch strings.ToLower(l.Toks[0]) {
+		case "pool":
+			p, err := parsePool(l.Toks[1:])
+			if err != nil {
+				return nil, fmt.Errorf("routes: %s:%d: %w", path, l.N, err)
+			}
+			if _, dup := defs[p.name]; dup {
+				return nil, fmt.Errorf("routes: %s:%d: pool %s redefined", path, l.N, p.name)
+			}
+			defs[p.name] = p
+		case "class":
+			c, err := parseClass(l.Toks[1:])
+			if err != nil {
+				return nil, fmt.Errorf("routes: %s:%d: %w", path, l.N, err)
+			}
+			if _, dup := clss[c.name]; dup {
+				return nil, fmt.Errorf("routes: %s:%d: class %s redefined", path, l.N, c.name)
+			}
+			clss[c.name] = c
+		}
+	}
+
+	r := &staticRouter{pools: defs, classes: clss}
+	r.fallback = Target{Kind: TargetDNS, class: clss[defaultClass]}
+	routed := map[*pool]bool{}
+	for _, l := range lines {
+		if kw := strings.ToLower(l.Toks[0]); kw == "pool" || kw == "class" {
+			continue
+		}
+		i := indexOf(l.Toks, "=>")
+		if i < 0 || i+1 >= len(l.Toks) {
+			return nil, fmt.Errorf("routes: %s:%d: want conditions => target", path, l.N)
+		}
+		m, err := parseMatchers(l.Toks[:i])
+		if err != nil {
+			return nil, fmt.Errorf("routes: %s:%d: %w", path, l.N, err)
+		}
+		t, err := parseTarget(l.Toks[i+1], defs)
+		if err != nil {
+			return nil, fmt.Errorf("routes: %s:%d: %w", path, l.N, err)
+		}
+		if err := parseOpts(&t, l.Toks[i+2:]); err != nil {
+			return nil, fmt.Errorf("routes: %s:%d: %w", path, l.N, err)
+		}
+		if _, ok := clss[t.Class]; len(t.Class) > 0 && !ok {
+			return nil, fmt.Errorf("routes: %s:%d: undefined class %q", path, l.N, t.Class)
+		} else if len(t.Class) > 0 {
+			t.class = clss[t.Class]
+		} else {
+			t.class = clss[defaultClass]
+		}
+		if t.Kind == TargetPool {
+			// members are probed via the proxy they're reached via
+			p := defs[t.Dst]
+			t.pool = p
+			if routed[p] && viaString(p.via) != viaString(t.Via) {
+				return nil, fmt.Errorf("routes: %s:%d: pool %s reached via %q and %q", path, l.N, p.name, viaString(p.via), viaString(t.Via))
+			}
+			p.via, routed[p] = t.Via, true
+		}
+		r.routes = append(r.routes, route{match: m, target: t, line: l.Raw})
+	}
+
+	log.Printf("routes: %d routes, %d pools, %d classes from %s", len(r.routes), len(defs), len(clss), path)
+	return r, nil
+}
+
+func (r *staticRouter) Route(c *Conn) Target {
+	for _, x := range r.routes {
+		if x.match(c) {
+			return x.target
+		}
+	}
+	return r.fallback
+}
+
+// run health checks pools, and collects idle buckets of classes, until
+// stop is closed
+func (r *staticRouter) run(stop <-chan struct{}) {
+	for _, p := range r.pools {
+		go p.healthcheck(stop)
+	}
+	for _, c := range r.classes {
+		c.run(stop)
+	}
+}
+
+func viaString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+func parseTarget(tok string, defs map[string]*pool) (Target, error) {
+	kind, dst, _ := strings.Cut(tok, ":")
+	t := Target{Kind: TargetKind(strings.ToLower(kind)), Dst: dst}
+	switch t.Kind {
+	case TargetDNS:
+		if len(dst) > 0 {
+			return t, fmt.Errorf("dns target takes no args: %q", tok)
+		}
+		return t, nil
+	case TargetAddr:
+		if _, _, err := net.SplitHostPort(dst); err != nil {
+			return t, fmt.Errorf("addr target: %w", err)
+		}
+		return t, nil
+	case TargetHost:
+		if len(dst) <= 0 {
+			return t, fmt.Errorf("host target: missing hostname")
+		}
+		return t, nil
+	case TargetPool:
+		if _, ok := defs[dst]; !ok {
+			return t, fmt.Errorf("pool target: undefined pool %q", dst)
+		}
+		return t, nil
+	}
+	return t, fmt.Errorf("unknown target %q", tok)
+}
+
+// parseOpts sets per-route options in toks on t:
+//
+//	pp=v1|v2                         send a PROXY protocol header to the backend
+//	via=socks5://[user:pass@]host:port  reach the backend via a socks5 proxy
+//	via=http://[user:pass@]host:port    reach the backend via a http proxy
+//	class=name                       shape as per the named class
+func parseOpts(t *Target, toks []string) error {
+	for _, tok := range toks {
+		k, v, ok := strings.Cut(tok, "=")
+		if !ok {
+			return fmt.Errorf("unexpected %q", tok)
+		}
+		switch k {
+		case "pp":
+			switch v {
+			case "v1":
+				t.ProxyProto = 1
+			case "v2":
+				t.ProxyProto = 2
+			default:
+				return fmt.Errorf("pp: want v1 or v2, got %q", v)
+			}
+		case "class":
+			t.Class = v
+		case "via":
+			u, err := parseVia(v)
+			if err != nil {
+				return err
+			}
+			t.Via = u
+		default:
+			return fmt.Errorf("unknown option %q", tok)
+		}
+	}
+	return nil
+}
+
+func indexOf(toks []string, x string) int {
+	for i := range toks {
+		if toks[i] == x {
+			return i
+		}
+	}
+	return -1
+}
+
+func mustRouter(path string) Router {
+	if r, err := LoadRoutes(path); err == nil {
+		return r
+	} else {
+		// with no usable routes, relay nothing; see mustPolicy
+		log.Print("relay: deny all; ", err)
+		policy = denyAll()
+		return dnsRouter{}
+	}
+}
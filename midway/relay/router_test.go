@@ -0,0 +1,82 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func loadRoutes(t *testing.T, conf string) *staticRouter {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes")
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.(*staticRouter)
+}
+
+func TestLoadRoutesTargets(t *testing.T) {
+	r := loadRoutes(t, `
+pool origins rr 127.0.0.1:1 check=none
+class default prio=2
+class bulk prio=6 conn=8mbit
+host:a.example => pool:origins
+host:b.example => dns class=bulk
+`)
+	a := r.Route(&Conn{HostName: "a.example"})
+	if a.pool != r.pools["origins"] || a.class != r.classes["default"] {
+		t.Fatalf("want pool origins, class default; got %+v", a)
+	}
+	if b := r.Route(&Conn{HostName: "b.example"}); b.class != r.classes["bulk"] {
+		t.Fatalf("want class bulk; got %+v", b)
+	}
+	if c := r.Route(&Conn{HostName: "c.example"}); c.Kind != TargetDNS || c.class != r.classes["default"] {
+		t.Fatalf("want unrouted conns over dns in class default; got %+v", c)
+	}
+}
+
+func TestUseRouterStopsHealthChecks(t *testing.T) {
+	var probes atomic.Int32
+	member := listen(t, func(net.Conn) { probes.Add(1) })
+
+	prev := router.Load()
+	defer UseRouter(prev.Router)
+
+	r := loadRoutes(t, "pool origins rr "+member+" interval=10ms\n* => pool:origins\n")
+	time.Sleep(50 * time.Millisecond)
+	if n := probes.Load(); n != 0 {
+		t.Fatalf("want no probes of a router not in use; got %d", n)
+	}
+
+	UseRouter(r)
+	if router.Load().Router != r {
+		t.Fatal("router not in use")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for probes.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if probes.Load() == 0 {
+		t.Fatal("want probes of the router in use")
+	}
+
+	UseRouter(nil)
+	time.Sleep(50 * time.Millisecond) // for probes in flight
+	n := probes.Load()
+	time.Sleep(100 * time.Millisecond)
+	if m := probes.Load(); m != n {
+		t.Fatalf("want no probes of a replaced router; got %d more", m-n)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celzero/gateway/midway/env"
+)
+
+const (
+	up   = 0 // client to backend
+	down = 1 // backend to client
+
+	defaultClass = "default"
+	maxPrio      = 7
+	maxChunk     = 16 << 10 // bytes written per take from buckets
+	minBurst     = 64 << 10 // bytes
+)
+
+// per direction budget shared by all relayed conns; nil if unlimited
+var link = linkBuckets(env.ShapeLinkRate())
+
+// class is a priority class relayed conns are shaped as per. Rates are
+// in bytes per sec, per direction; and 0 means unlimited.
+type class struct {
+	name string
+	prio int // 0 (highest) to maxPrio (lowest)
+
+	conn   [2]float64 // each conn
+	client [2]float64 // all conns from a client ip
+	host   [2]float64 // all conns to a host
+	total  [2]float64 // all conns in this class
+
+	totals  [2]*bucket
+	clients [2]*buckets
+	hosts   [2]*buckets
+}
+
+// parseClass parses a class definition (sans the leading "class"):
+//
+//	<name> [prio=0..7] [conn=<rate>] [client=<rate>] [host=<rate>]
+//	    [total=<rate>]
+//
+// Rates are like 512kbit, 10mbit, 1gbit, or 64kbps, 2mbps (bytes),
+// and apply to each direction; unless suffixed with .up (client to
+// backend) or .down (backend to client), as in conn.down=8mbit.
+func parseClass(toks []string) (*class, error) {
+	if len(toks) < 1 {
+		return nil, fmt.Errorf("want: class <name> [opts]")
+	}
+	c := &class{name: toks[0], prio: maxPrio / 2}
+	for _, tok := range toks[1:] {
+		k, v, ok := strings.Cut(tok, "=")
+		if !ok {
+			return nil, fmt.Errorf("class %s: unexpected %q", c.name, tok)
+		}
+		if k == "prio" {
+			p, err := strconv.Atoi(v)
+			if err != nil || p < 0 || p > maxPrio {
+				return nil, fmt.Errorf("class %s: prio must be 0 to %d", c.name, maxPrio)
+			}
+			c.prio = p
+			continue
+		}
+
+		r, err := parseRate(v)
+		if err != nil {
+			return nil, fmt.Errorf("class %s: %s: %w", c.name, tok, err)
+		}
+		what, dir, _ := strings.Cut(k, ".")
+		var rates *[2]float64
+		switch what {
+		case "conn":
+			rates = &c.conn
+		case "client":
+			rates = &c.client
+		case "host":
+			rates = &c.host
+		case "total":
+			rates = &c.total
+		default:
+			return nil, fmt.Errorf("class %s: unknown option %q", c.name, tok)
+		}
+		switch dir {
+		case "":
+			rates[up], rates[down] = r, r
+		case "up":
+			rates[up] = r
+		case "down":
+			rates[down] = r
+		default:
+			return nil, fmt.Errorf("class %s: want .up or .down, got %q", c.name, tok)
+		}
+	}
+
+	for d := range c.totals {
+		c.totals[d] = newBucket(c.total[d])
+		c.clients[d] = newBuckets(c.client[d])
+		c.hosts[d] = newBuckets(c.host[d])
+	}
+	return c, nil
+}
+
+// parseRate parses rates in bits or bytes per sec, to bytes per sec
+func parseRate(v string) (float64, error) {
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"gbit", 1e9 / 8}, {"mbit", 1e6 / 8}, {"kbit", 1e3 / 8}, {"bit", 1.0 / 8},
+		{"gbps", 1e9}, {"mbps", 1e6}, {"kbps", 1e3}, {"bps", 1},
+	}
+	v = strings.ToLower(v)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(v, u.suffix), 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("bad rate %q", v)
+			}
+			return n * u.mult, nil
+		}
+	}
+	return 0, fmt.Errorf("rate %q needs a unit, like kbit or mbps", v)
+}
+
+// run collects idle client and host buckets of c until stop is closed
+func (c *class) run(stop <-chan struct{}) {
+	for d := range c.clients {
+		for _, bs := range []*buckets{c.clients[d], c.hosts[d]} {
+			if bs != nil {
+				go bs.gc(stop)
+			}
+		}
+	}
+}
+
+func linkBuckets(rate string) [2]*bucket {
+	if len(rate) <= 0 {
+		return [2]*bucket{}
+	}
+	r, err := parseRate(rate)
+	if err != nil {
+		log.Print("shape: link rate unlimited; ", err)
+		return [2]*bucket{}
+	}
+	log.Printf("shape: link rate %.0f bytes/s each way", r)
+	return [2]*bucket{newBucket(r), newBucket(r)}
+}
+
+// shaper returns a shaped writer (sans w) that takes from the buckets
+// bytes in direction dir of conn c to target t are limited by; or nil
+// if bytes in that direction aren't shaped at all. Callers release it
+// once c is done.
+func shaper(c *Conn, t Target, dir int) *shaped {
+	cls := t.class
+
+	s := &shaped{}
+	if link[dir] != nil {
+		s.buckets = append(s.buckets, link[dir])
+	}
+	if cls != nil {
+		s.prio = cls.prio
+		if b := newBucket(cls.conn[dir]); b != nil {
+			s.buckets = append(s.buckets, b)
+		}
+		if ip, ok := clientIP(c); ok {
+			s.hold(cls.clients[dir], ip.String())
+		}
+		s.hold(cls.hosts[dir], canonicalHost(c.HostName))
+		if cls.totals[dir] != nil {
+			s.buckets = append(s.buckets, cls.totals[dir])
+		}
+	}
+	if len(s.buckets) <= 0 {
+		return nil
+	}
+	return s
+}
+
+// shaped is an io.Writer that doles out writes to w as per buckets
+type shaped struct {
+	w       io.Writer
+	buckets []*bucket
+	prio    int
+	held    []held // of buckets, shared by key
+}
+
+// held is a reference to the bucket for key k in bs
+type held struct {
+	bs *buckets
+	k  string
+}
+
+// hold adds the bucket for k in bs, if any, to s
+func (s *shaped) hold(bs *buckets, k string) {
+	if b := bs.get(k); b != nil {
+		s.buckets = append(s.buckets, b)
+		s.held = append(s.held, held{bs, k})
+	}
+}
+
+// release lets go of the keyed buckets s holds; s may be nil
+func (s *shaped) release() {
+	if s == nil {
+		return
+	}
+	for _, h := range s.held {
+		h.bs.put(h.k)
+	}
+	s.held = nil
+}
+
+func (s *shaped) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		sz := len(p)
+		if sz > maxChunk {
+			sz = maxChunk
+		}
+		s.take(sz)
+		m, err := s.w.Write(p[:sz])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[sz:]
+	}
+	return n, nil
+}
+
+func (s *shaped) take(n int) {
+	for _, b := range s.buckets {
+		b.take(n, s.prio)
+	}
+}
+
+// shapedBody is a request or response body read as per sh
+type shapedBody struct {
+	io.ReadCloser
+	sh *shaped
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.sh.take(n)
+	}
+	return n, err
+}
+
+// bucket is a token bucket of bytes
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per sec
+	burst  float64 // max tokens
+	tokens float64
+	last   time.Time // of the last refill
+}
+
+// newBucket returns a bucket for rate bytes per sec; or nil if rate
+// is unlimited (<= 0).
+func newBucket(rate float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take blocks until n tokens can be taken while leaving behind enough
+// tokens for conns of higher priority: lower priority (higher prio)
+// conns only get tokens once the bucket is fuller.
+func (b *bucket) take(n int, prio int) {
+	reserve := b.burst * float64(prio) / float64(maxPrio+1)
+	if reserve > b.burst-float64(n) {
+		reserve = b.burst - float64(n)
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+
+		if b.tokens-float64(n) >= reserve {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return
+		}
+		need := float64(n) + reserve - b.tokens
+		b.mu.Unlock()
+
+		time.Sleep(time.Duration(need / b.rate * float64(time.Second)))
+	}
+}
+
+// buckets are buckets by key (client ip, or hostname), all with the
+// same rate; buckets no conn holds are forgotten once idle a while.
+type buckets struct {
+	mu   sync.Mutex
+	rate float64
+	m    map[string]*bucket
+	refs map[string]int // conns holding each bucket
+}
+
+func newBuckets(rate float64) *buckets {
+	if rate <= 0 {
+		return nil
+	}
+	return &buckets{rate: rate, m: make(map[string]*bucket), refs: make(map[string]int)}
+}
+
+// get returns the bucket for k, holding a reference to it for put
+func (bs *buckets) get(k string) *bucket {
+	if bs == nil {
+		return nil
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b := bs.m[k]
+	if b == nil {
+		b = newBucket(bs.rate)
+		bs.m[k] = b
+	}
+	bs.refs[k]++
+	return b
+}
+
+// put lets go of a reference taken by get
+func (bs *buckets) put(k string) {
+	if bs == nil {
+		return
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.refs[k]--; bs.refs[k] <= 0 {
+		delete(bs.refs, k)
+	}
+}
+
+// gc forgets buckets idle for a minute, that no conn holds, until stop
+// is closed
+func (bs *buckets) gc(stop <-chan struct{}) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		bs.sweep(time.Now())
+	}
+}
+
+// sweep forgets buckets idle for a minute before now, that no conn holds
+func (bs *buckets) sweep(now time.Time) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for k, b := range bs.m {
+		if bs.refs[k] > 0 {
+			continue // in use, however idle
+		}
+		b.mu.Lock()
+		idle := now.Sub(b.last) > time.Minute
+		b.mu.Unlock()
+		if idle {
+			delete(bs.m, k)
+		}
+	}
+}
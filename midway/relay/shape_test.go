@@ -0,0 +1,194 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want float64 // bytes per sec
+	}{
+		{"8bit", 1},
+		{"512kbit", 64e3},
+		{"10mbit", 1.25e6},
+		{"1gbit", 125e6},
+		{"1.5Mbit", 187.5e3},
+		{"64kbps", 64e3},
+		{"2mbps", 2e6},
+		{"1gbps", 1e9},
+		{"100bps", 100},
+		{"0mbit", 0},
+	} {
+		got, err := parseRate(tc.v)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: want %g; got %g (err %v)", tc.v, tc.want, got, err)
+		}
+	}
+	for _, v := range []string{"", "10", "10mb", "mbit", "-1mbit", "x1kbit"} {
+		if _, err := parseRate(v); err == nil {
+			t.Errorf("%q: want err", v)
+		}
+	}
+}
+
+func TestParseClass(t *testing.T) {
+	c, err := parseClass(strings.Fields("bulk prio=6 conn=8mbit client.up=1mbps client.down=2mbps host.down=16mbit total=100mbit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.name != "bulk" || c.prio != 6 {
+		t.Fatalf("want bulk at prio 6; got %s at %d", c.name, c.prio)
+	}
+	want := map[string][2]float64{
+		"conn":   {1e6, 1e6},
+		"client": {1e6, 2e6},
+		"host":   {0, 2e6},
+		"total":  {12.5e6, 12.5e6},
+	}
+	got := map[string][2]float64{"conn": c.conn, "client": c.client, "host": c.host, "total": c.total}
+	for k := range want {
+		if got[k] != want[k] {
+			t.Errorf("%s: want %v; got %v", k, want[k], got[k])
+		}
+	}
+	// unlimited rates have no buckets
+	if c.hosts[up] != nil || c.hosts[down] == nil || c.totals[up] == nil || c.clients[up] == nil {
+		t.Fatalf("want buckets for limited rates alone; got hosts %v, totals %v, clients %v", c.hosts, c.totals, c.clients)
+	}
+
+	def, err := parseClass([]string{"default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.prio != maxPrio/2 || def.totals[up] != nil || def.clients[down] != nil {
+		t.Fatalf("want an unlimited class at prio %d; got %+v", maxPrio/2, def)
+	}
+
+	for _, toks := range []string{
+		"",
+		"bulk prio=8",
+		"bulk prio=-1",
+		"bulk prio=high",
+		"bulk conn",
+		"bulk conn=8",
+		"bulk conns=8mbit",
+		"bulk conn.sideways=8mbit",
+	} {
+		if _, err := parseClass(strings.Fields(toks)); err == nil {
+			t.Errorf("%q: want err", toks)
+		}
+	}
+}
+
+func TestBucketPrioReserve(t *testing.T) {
+	const rate = 1e8 // bytes per sec
+	b := newBucket(rate)
+	if b.burst != rate || b.tokens != rate {
+		t.Fatalf("want a full bucket of burst %g; got %g of %g", float64(rate), b.tokens, b.burst)
+	}
+	// under a prio 7 conn's reserve of 7/8th of the burst
+	half := func() {
+		b.mu.Lock()
+		b.tokens, b.last = rate/2, time.Now()
+		b.mu.Unlock()
+	}
+
+	half()
+	start := time.Now()
+	b.take(1000, 0)
+	if took := time.Since(start); took > 10*time.Millisecond {
+		t.Fatalf("want prio 0 conns to take tokens at once; took %s", took)
+	}
+
+	half()
+	start = time.Now()
+	b.take(1000, maxPrio)
+	// (7/8 - 1/2) of rate, at rate, is 375ms
+	if took := time.Since(start); took < 300*time.Millisecond {
+		t.Fatalf("want prio %d conns to wait for the reserve; took %s", maxPrio, took)
+	}
+
+	// takes bigger than the burst less the reserve wait for a full bucket
+	b.take(int(b.burst), maxPrio)
+}
+
+func TestBucketsRefs(t *testing.T) {
+	bs := newBuckets(1e6)
+	a := bs.get("a")
+	if bs.get("a") != a || bs.get("b") == a {
+		t.Fatal("want a bucket per key")
+	}
+	later := time.Now().Add(2 * time.Minute)
+
+	// held buckets are kept, however idle
+	bs.put("a")
+	bs.sweep(later)
+	if bs.m["a"] == nil || bs.m["b"] == nil {
+		t.Fatal("want held buckets kept")
+	}
+
+	bs.put("a")
+	bs.put("b")
+	bs.sweep(time.Now())
+	if bs.m["a"] == nil {
+		t.Fatal("want buckets not yet idle kept")
+	}
+	bs.sweep(later)
+	if len(bs.m) != 0 || len(bs.refs) != 0 {
+		t.Fatalf("want idle buckets no one holds forgotten; got %d, refs %v", len(bs.m), bs.refs)
+	}
+
+	var none *buckets
+	if none.get("a") != nil {
+		t.Fatal("want no buckets of unlimited rates")
+	}
+	none.put("a")
+}
+
+func TestShaper(t *testing.T) {
+	cls, err := parseClass(strings.Fields("bulk prio=6 conn.down=8mbit client=16mbit host=32mbit total=100mbit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Conn{HostName: "Dl.Example.com.", Conn: from("192.0.2.1")}
+	to := Target{Kind: TargetDNS, class: cls}
+
+	// conn, client, host, total
+	sd := shaper(c, to, down)
+	if sd == nil || len(sd.buckets) != 4 || sd.prio != 6 {
+		t.Fatalf("want 4 buckets at prio 6; got %+v", sd)
+	}
+	// client, host, total; conn.down limits down alone
+	su := shaper(c, to, up)
+	if su == nil || len(su.buckets) != 3 {
+		t.Fatalf("want 3 buckets; got %+v", su)
+	}
+	// conns of a client, and to a host, share their buckets
+	if sd.buckets[1] != cls.clients[down].m["192.0.2.1"] || sd.buckets[2] != cls.hosts[down].m["dl.example.com"] {
+		t.Fatal("want client and host buckets by ip and canonical host")
+	}
+	if n := cls.clients[down].refs["192.0.2.1"]; n != 1 {
+		t.Fatalf("want 1 ref to the client bucket; got %d", n)
+	}
+	sd.release()
+	sd.release()
+	if n := cls.clients[down].refs["192.0.2.1"]; n != 0 {
+		t.Fatalf("want no refs to the client bucket once released; got %d", n)
+	}
+	su.release()
+
+	// unshaped conns, sans a link rate, have no shaper
+	if link[down] == nil && shaper(c, Target{Kind: TargetDNS}, down) != nil {
+		t.Fatal("want no shaper sans a class")
+	}
+	var nothing *shaped
+	nothing.release()
+}
@@ -1,71 +0,0 @@
-// Copyright (c) 2022 RethinkDNS and its authors.
-//
-// This Source Code Form is subject to the terms of the Mozilla Public
-// License, v. 2.0. If a copy of the MPL was not distributed with this
-// file, You can obtain one at http://mozilla.org/MPL/2.0/.
-//
-// This file incorporates work covered by the following copyright and
-// permission notice:
-//
-//   Copyright 2017 Google Inc.
-//
-//   Licensed under the Apache License, Version 2.0 (the "License");
-//   you may not use this file except in compliance with the License.
-//   You may obtain a copy of the License at
-//
-//        http://www.apache.org/licenses/LICENSE-2.0
-//
-//   Unless required by applicable law or agreed to in writing, software
-//   distributed under the License is distributed on an "AS IS" BASIS,
-//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-//   See the License for the specific language governing permissions and
-//   limitations under the License.
-
-// Adopted from: github.com/inetaf/tcpproxy/blob/be3ee21/sni.go
-package relay
-
-import (
-	"bufio"
-	"bytes"
-	"crypto/tls"
-	"io"
-	"net"
-)
-
-// clientHelloServerName returns the SNI server name inside the TLS ClientHello,
-// without consuming any bytes from br.
-// On any error, the empty string is returned.
-func clientHelloServerName(br *bufio.Reader) (sni string) {
-	const recordHeaderLen = 5
-	hdr, err := br.Peek(recordHeaderLen)
-	if err != nil {
-		return ""
-	}
-	const recordTypeHandshake = 0x16
-	if hdr[0] != recordTypeHandshake {
-		return "" // Not TLS.
-	}
-	recLen := int(hdr[3])<<8 | int(hdr[4]) // ignoring version in hdr[1:3]
-	helloBytes, err := br.Peek(recordHeaderLen + recLen)
-	if err != nil {
-		return ""
-	}
-	tls.Server(sniSniffConn{r: bytes.NewReader(helloBytes)}, &tls.Config{
-		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
-			sni = hello.ServerName
-			return nil, nil
-		},
-	}).Handshake()
-	return
-}
-
-// sniSniffConn is a net.Conn that reads from r, fails on Writes,
-// and crashes otherwise.
-type sniSniffConn struct {
-	r        io.Reader
-	net.Conn // nil; crash on any unexpected use
-}
-
-// ref: archive.is/SdYhp
-func (c sniSniffConn) Read(p []byte) (int, error) { return c.r.Read(p) }
-func (sniSniffConn) Write(p []byte) (int, error)  { return 0, io.EOF }
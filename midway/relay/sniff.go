@@ -0,0 +1,191 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+// protocols sniffed by default
+const (
+	ProtoHTTP    = "http"
+	ProtoTLS     = "tls"
+	ProtoH2C     = "h2c"     // http2 with prior knowledge
+	ProtoSSH     = "ssh"     // rfc4253
+	ProtoProxy   = "proxy"   // proxy-proto v1 / v2 wrapped, from another proxy
+	ProtoOpenVPN = "openvpn" // openvpn over tcp
+)
+
+// SniffResult is what a Sniffer makes of the bytes it is shown
+type SniffResult int
+
+const (
+	SniffNo   SniffResult = iota // not this protocol
+	SniffYes                     // this protocol
+	SniffMore                    // can't tell without more bytes
+)
+
+// maxSniff is the most bytes sniffers are shown
+const maxSniff = 64
+
+// Sniffer tells whether b, the first bytes a client sent, are of its
+// protocol. b is never empty, but may be shorter than the sniffer needs
+// to be sure, in which case it must return SniffMore.
+type Sniffer func(b []byte) SniffResult
+
+type namedSniffer struct {
+	proto string
+	sniff Sniffer
+}
+
+var (
+	sniffmu  sync.RWMutex
+	sniffers = []namedSniffer{
+		// h2c's preface looks like a http/1.x request, and so must go first
+		{ProtoH2C, prefixSniffer([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))},
+		{ProtoProxy, sniffProxyProto},
+		{ProtoSSH, prefixSniffer([]byte("SSH-"))},
+		{ProtoTLS, sniffTLS},
+		{ProtoHTTP, sniffHTTP},
+		{ProtoOpenVPN, sniffOpenVPN},
+	}
+)
+
+// RegisterSniffer adds s, which sniffs for proto, ahead of all sniffers
+// registered prior (including those for the protocols above). Conns
+// sniffed as proto can be matched with "proto:<proto>" in routes and
+// policies.
+func RegisterSniffer(proto string, s Sniffer) {
+	sniffmu.Lock()
+	defer sniffmu.Unlock()
+	sniffers = append([]namedSniffer{{proto, s}}, sniffers...)
+}
+
+// sniff returns the protocol the bytes in br are of, if any sniffer
+// recognises them, without consuming any bytes from br. Sniffers are
+// tried in order, and the first to say yes wins; but if one needs more
+// bytes, those after it wait for them, too.
+func sniff(br *bufio.Reader) string {
+	sniffmu.RLock()
+	all := sniffers
+	sniffmu.RUnlock()
+
+	n := 1
+	for {
+		b, err := br.Peek(n)
+		if m := br.Buffered(); m > len(b) {
+			b, _ = br.Peek(m)
+		}
+		if len(b) <= 0 {
+			return ""
+		}
+		if len(b) > maxSniff {
+			b = b[:maxSniff]
+		}
+
+		more := false
+		for _, s := range all {
+			r := s.sniff(b)
+			if r == SniffYes {
+				return s.proto
+			} else if r == SniffMore {
+				more = true
+				break
+			}
+		}
+		if !more || err != nil || len(b) >= maxSniff {
+			return ""
+		}
+		n = len(b) + 1
+	}
+}
+
+func prefixSniffer(prefix []byte) Sniffer {
+	return func(b []byte) SniffResult {
+		if len(b) >= len(prefix) {
+			if bytes.HasPrefix(b, prefix) {
+				return SniffYes
+			}
+			return SniffNo
+		}
+		if bytes.HasPrefix(prefix, b) {
+			return SniffMore
+		}
+		return SniffNo
+	}
+}
+
+var (
+	ppv1sig = []byte("PROXY ")
+	ppv2sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	sniffPPv1 = prefixSniffer(ppv1sig)
+	sniffPPv2 = prefixSniffer(ppv2sig)
+)
+
+func sniffProxyProto(b []byte) SniffResult {
+	r1, r2 := sniffPPv1(b), sniffPPv2(b)
+	if r1 == SniffYes || r2 == SniffYes {
+		return SniffYes
+	} else if r1 == SniffMore || r2 == SniffMore {
+		return SniffMore
+	}
+	return SniffNo
+}
+
+// sniffTLS looks for a handshake record, of tls1.0 or later
+func sniffTLS(b []byte) SniffResult {
+	const recordTypeHandshake = 0x16
+	if b[0] != recordTypeHandshake {
+		return SniffNo
+	} else if len(b) < 2 {
+		return SniffMore
+	} else if b[1] != 0x03 {
+		return SniffNo
+	}
+	return SniffYes
+}
+
+// sniffHTTP looks for a http/1.x method token, like "GET ", and so
+// also matches other protocols with requests of that form, like RTSP.
+func sniffHTTP(b []byte) SniffResult {
+	const maxMethod = 16
+	for i := range b {
+		if b[i] == ' ' && i > 0 {
+			return SniffYes
+		} else if b[i] < 'A' || b[i] > 'Z' || i >= maxMethod {
+			return SniffNo
+		}
+	}
+	return SniffMore
+}
+
+// sniffOpenVPN looks for a P_CONTROL_HARD_RESET_CLIENT_V2 / V3 packet
+// (with key_id 0) prefixed with its length, which is how openvpn clients
+// open tcp conns; see openvpn's ssl_pkt.h
+func sniffOpenVPN(b []byte) SniffResult {
+	const (
+		hardResetClientV2 = 7
+		hardResetClientV3 = 10
+		minLen            = 14 // opcode, session id, ack len, packet id
+		maxLen            = 1500
+	)
+	if len(b) < 3 {
+		return SniffMore
+	}
+	n := binary.BigEndian.Uint16(b[:2])
+	opcode, keyid := b[2]>>3, b[2]&0x07
+	if n < minLen || n > maxLen || keyid != 0 {
+		return SniffNo
+	}
+	if opcode == hardResetClientV2 || opcode == hardResetClientV3 {
+		return SniffYes
+	}
+	return SniffNo
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/celzero/gateway/midway/env"
+)
+
+// rfc1928 and rfc1929
+const (
+	socks5ver    = 0x05
+	socksAuthVer = 0x01
+
+	socksNoAuth     = 0x00
+	socksUserPass   = 0x02
+	socksNoMethods  = 0xff
+	socksCmdConnect = 0x01
+
+	socksAtypIP4    = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIP6    = 0x04
+
+	socksOK             = 0x00
+	socksFailure        = 0x01
+	socksNotAllowed     = 0x02
+	socksHostUnreach    = 0x04
+	socksCmdUnsupported = 0x07
+	socksAtypUnsupport  = 0x08
+)
+
+var (
+	errSocks = errors.New("bad request")
+
+	// user => password, for clients of both socks5 and http proxies
+	proxyusers = env.SocksUsers()
+)
+
+// HasProxyUsers tells whether any users are set up to authenticate
+// clients of the socks5 and http proxies with; without which, neither
+// must be served, lest they be open relays.
+func HasProxyUsers() bool {
+	return len(proxyusers) > 0
+}
+
+// proxyAuth tells whether pass is user's password
+func proxyAuth(user, pass string) bool {
+	want, ok := proxyusers[user]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1
+}
+
+// NewSocksConn performs the socks5 handshake and username / password
+// auth with the client on c, and reads its CONNECT request. On errors, c is sent a socks5 failure reply,
+// closed, and nil is returned.
+func NewSocksConn(c net.Conn) *Conn {
+	br := bufio.NewReader(c)
+
+	_ = c.SetDeadline(time.Now().Add(conntimeout))
+	host, port, code, err := socksHandshake(br, c)
+	_ = c.SetDeadline(time.Time{})
+
+	if err != nil {
+		log.Printf("socks5: %s from %s", err, c.RemoteAddr())
+		if code != socksOK {
+			socksReply(c, code)
+		}
+		c.Close()
+		return nil
+	}
+
+	// bytes the client sent after the request, if any
+	peeked, _ := br.Peek(br.Buffered())
+
+	return &Conn{
+		ID:       nextConnID(),
+		Typ:      "tcp",
+		HostName: host,
+		Port:     port,
+		Peeked:   peeked,
+		Conn:     c,
+		ack: func(err error) {
+			if err == nil {
+				socksReply(c, socksOK)
+			} else if errors.Is(err, errDenied) {
+				socksReply(c, socksNotAllowed)
+			} else {
+				socksReply(c, socksHostUnreach)
+			}
+		},
+	}
+}
+
+// socksHandshake returns the host and port the client wants to connect
+// to; or on errors, the reply code to fail the request with, if any.
+func socksHandshake(br *bufio.Reader, w io.Writer) (host, port string, code byte, err error) {
+	// greeting: ver, nmethods, methods...
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(br, hdr); err != nil {
+		return
+	}
+	if hdr[0] != socks5ver {
+		err = fmt.Errorf("%w: version %d", errSocks, hdr[0])
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(br, methods); err != nil {
+		return
+	}
+
+	want := byte(socksUserPass)
+	if !hasByte(methods, want) {
+		_, _ = w.Write([]byte{socks5ver, socksNoMethods})
+		err = fmt.Errorf("%w: no acceptable auth method in %v", errSocks, methods)
+		return
+	}
+	if _, err = w.Write([]byte{socks5ver, want}); err != nil {
+		return
+	}
+	if err = socksAuth(br, w); err != nil {
+		return
+	}
+
+	// request: ver, cmd, rsv, atyp, dst.addr, dst.port
+	req := make([]byte, 4)
+	if _, err = io.ReadFull(br, req); err != nil {
+		return
+	}
+	if req[0] != socks5ver {
+		code, err = socksFailure, fmt.Errorf("%w: version %d", errSocks, req[0])
+		return
+	}
+	if req[1] != socksCmdConnect {
+		code, err = socksCmdUnsupported, fmt.Errorf("%w: cmd %d", errSocks, req[1])
+		return
+	}
+
+	var addr []byte
+	switch req[3] {
+	case socksAtypIP4:
+		addr = make([]byte, net.IPv4len)
+	case socksAtypIP6:
+		addr = make([]byte, net.IPv6len)
+	case socksAtypDomain:
+		var n byte
+		if n, err = br.ReadByte(); err != nil {
+			return
+		}
+		addr = make([]byte, n)
+	default:
+		code, err = socksAtypUnsupport, fmt.Errorf("%w: atyp %d", errSocks, req[3])
+		return
+	}
+	if _, err = io.ReadFull(br, addr); err != nil {
+		return
+	}
+	p := make([]byte, 2)
+	if _, err = io.ReadFull(br, p); err != nil {
+		return
+	}
+
+	if req[3] == socksAtypDomain {
+		host = string(addr)
+	} else {
+		host = net.IP(addr).String()
+	}
+	port = strconv.Itoa(int(binary.BigEndian.Uint16(p)))
+	if len(host) <= 0 {
+		code, err = socksFailure, fmt.Errorf("%w: empty host", errSocks)
+	}
+	return
+}
+
+// socksAuth performs rfc1929 username / password auth
+func socksAuth(br *bufio.Reader, w io.Writer) error {
+	readstr := func() (string, error) {
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+
+	ver, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ver != socksAuthVer {
+		return fmt.Errorf("%w: auth version %d", errSocks, ver)
+	}
+	user, err := readstr()
+	if err != nil {
+		return err
+	}
+	pass, err := readstr()
+	if err != nil {
+		return err
+	}
+
+	if !proxyAuth(user, pass) {
+		_, _ = w.Write([]byte{socksAuthVer, socksFailure})
+		return fmt.Errorf("%w: auth failed for %q", errSocks, user)
+	}
+	_, err = w.Write([]byte{socksAuthVer, socksOK})
+	return err
+}
+
+// socksReply sends reply code to the client; bnd.addr is always
+// 0.0.0.0:0, as the client has no use for it.
+func socksReply(c net.Conn, code byte) {
+	_ = c.SetWriteDeadline(time.Now().Add(conntimeout))
+	_, _ = c.Write([]byte{socks5ver, code, 0x00, socksAtypIP4, 0, 0, 0, 0, 0, 0})
+	_ = c.SetWriteDeadline(time.Time{})
+}
+
+func hasByte(b []byte, x byte) bool {
+	for i := range b {
+		if b[i] == x {
+			return true
+		}
+	}
+	return false
+}
@@ -29,6 +29,11 @@ func (l *splitListener) Accept() (net.Conn, error) {
 			return nil, err
 		}
 
+		c, ok := Admit(c)
+		if !ok {
+			continue // shed
+		}
+
 		if d, ok := l.onConn(c); !ok {
 			// parent tls-listener handles conn
 			return d, nil
@@ -0,0 +1,126 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// viaDialer returns a dialFunc that tunnels conns through the upstream
+// proxy at u, which is one of:
+//
+//	socks5://[user:pass@]host:port
+//	socks5h://[user:pass@]host:port (names of dns targets, too, sent as-is)
+//	http://[user:pass@]host:port    (HTTP CONNECT)
+//
+// Which of names or ips are sent to the proxy is up to dialContext.
+func viaDialer(u *url.URL) (dialFunc, error) {
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			pwd, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pwd}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, trustedDialer{})
+		if err != nil {
+			return nil, err
+		}
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			return cd.DialContext, nil
+		}
+		return func(_ context.Context, network, addr string) (net.Conn, error) {
+			return d.Dial(network, addr)
+		}, nil
+	case "http":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return httpConnect(ctx, u, addr)
+		}, nil
+	}
+	return nil, fmt.Errorf("via: unsupported proxy %q", u.Redacted())
+}
+
+func parseVia(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("via: %w", err)
+	}
+	if _, err := viaDialer(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// httpConnect asks the http proxy at u to tunnel a conn to addr
+func httpConnect(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	c, err := trustedDialer{}.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(d)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pwd, _ := u.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pwd))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	// a 2xx to CONNECT has no body (rfc7231 section 4.3.6), and so,
+	// res.Body must not be read from (or closed, which drains it).
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		c.Close()
+		return nil, fmt.Errorf("via: %s: connect %s: %s", u.Host, addr, res.Status)
+	}
+
+	_ = c.SetDeadline(time.Time{})
+	// bytes from the backend that were read in along with the response
+	peeked, _ := br.Peek(br.Buffered())
+	return &Conn{Peeked: peeked, Conn: c}, nil
+}
+
+// trustedDialer dials operator-configured addrs, such as those of
+// upstream proxies, without discarding private ips.
+type trustedDialer struct{}
+
+func (trustedDialer) Dial(network, addr string) (net.Conn, error) {
+	return dialHostPort(network, addr, true)
+}
+
+func (trustedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialContext(ctx, nil, network, addr, true)
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	viaUser   = "u"
+	viaPass   = "p"
+	viaBanner = "early" // sent by the http proxy along with its 200
+)
+
+// listen serves each conn to a local addr with h until the test ends
+func listen(t *testing.T, h func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				h(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echo(c net.Conn) { _, _ = io.Copy(c, c) }
+
+// egressName resolves at the proxies alone, to 127.0.0.1
+const egressName = "backend.egress.test"
+
+// tunnel pipes c to a conn it dials to addr
+func tunnel(c net.Conn, addr string) {
+	if host, port, _ := net.SplitHostPort(addr); host == egressName {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	b, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer b.Close()
+	go func() { _, _ = io.Copy(b, c) }()
+	_, _ = io.Copy(c, b)
+}
+
+// socks5Server is a rfc1928 server that wants rfc1929 auth, and refuses
+// to connect to refused
+func socks5Server(refused string) func(net.Conn) {
+	return func(c net.Conn) {
+		br := bufio.NewReader(c)
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(br, hdr); err != nil || hdr[0] != 5 {
+			return
+		}
+		methods := make([]byte, hdr[1])
+		if _, err := io.ReadFull(br, methods); err != nil {
+			return
+		}
+		if !strings.ContainsRune(string(methods), socksUserPass) {
+			_, _ = c.Write([]byte{5, 0xff})
+			return
+		}
+		_, _ = c.Write([]byte{5, socksUserPass})
+
+		// ver, ulen, user, plen, pass
+		ver, _ := br.ReadByte()
+		ulen, _ := br.ReadByte()
+		user := make([]byte, ulen)
+		_, _ = io.ReadFull(br, user)
+		plen, _ := br.ReadByte()
+		pass := make([]byte, plen)
+		if _, err := io.ReadFull(br, pass); err != nil || ver != 1 {
+			return
+		}
+		if string(user) != viaUser || string(pass) != viaPass {
+			_, _ = c.Write([]byte{1, 1})
+			return
+		}
+		_, _ = c.Write([]byte{1, 0})
+
+		// ver, cmd, rsv, atyp; and an ipv4 addr, or a name, and a port
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(br, req); err != nil || req[1] != 1 {
+			return
+		}
+		var host []byte
+		switch req[3] {
+		case 1:
+			host = make([]byte, 4)
+		case 3:
+			n, _ := br.ReadByte()
+			host = make([]byte, n)
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		if _, err := io.ReadFull(br, host); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(br, port); err != nil {
+			return
+		}
+		if req[3] == 1 {
+			host = []byte(net.IP(host).String())
+		}
+		addr := net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+		if addr == refused {
+			_, _ = c.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0}) // not allowed
+			return
+		}
+		_, _ = c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		tunnel(&Conn{Peeked: peekedOf(br), Conn: c}, addr)
+	}
+}
+
+// connectServer is a http CONNECT proxy that wants basic auth, and
+// refuses to connect to refused
+func connectServer(refused string) func(net.Conn) {
+	return func(c net.Conn) {
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		user, pass, ok := (&http.Request{Header: http.Header{
+			"Authorization": req.Header.Values("Proxy-Authorization"),
+		}}).BasicAuth()
+		switch {
+		case !ok || user != viaUser || pass != viaPass:
+			_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return
+		case req.Host == refused:
+			_, _ = io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		// the backend's first bytes arrive along with the response
+		_, _ = io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n"+viaBanner)
+		tunnel(&Conn{Peeked: peekedOf(br), Conn: c}, req.Host)
+	}
+}
+
+func peekedOf(br *bufio.Reader) []byte {
+	b, _ := br.Peek(br.Buffered())
+	return b
+}
+
+func TestViaDialer(t *testing.T) {
+	backend := listen(t, echo)
+	refused := listen(t, echo)
+	socks := listen(t, socks5Server(refused))
+	connect := listen(t, connectServer(refused))
+
+	_, port, _ := net.SplitHostPort(backend)
+	byName := net.JoinHostPort(egressName, port)
+
+	tests := []struct {
+		name      string
+		via       string
+		to        string
+		untrusted bool   // resolved by midway; else, by the proxy
+		banner    string // want first
+		err       string // want an err with; or empty
+	}{
+		{name: "socks5", via: "socks5://u:p@" + socks, to: backend},
+		{name: "socks5 bad auth", via: "socks5://u:nope@" + socks, to: backend, err: "username/password authentication failed"},
+		{name: "socks5 sans auth", via: "socks5://" + socks, to: backend, err: "no acceptable authentication methods"},
+		{name: "socks5 refused", via: "socks5://u:p@" + socks, to: refused, err: "connection not allowed by ruleset"},
+		{name: "connect", via: "http://u:p@" + connect, to: backend, banner: viaBanner},
+		{name: "connect bad auth", via: "http://u:nope@" + connect, to: backend, err: "407"},
+		{name: "connect sans auth", via: "http://" + connect, to: backend, err: "407"},
+		{name: "connect refused", via: "http://u:p@" + connect, to: refused, err: "403"},
+		{name: "socks5 by name", via: "socks5://u:p@" + socks, to: byName},
+		{name: "connect by name", via: "http://u:p@" + connect, to: byName, banner: viaBanner},
+		{name: "socks5 untrusted by ip", via: "socks5://u:p@" + socks, to: byName, untrusted: true, err: egressName},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := parseVia(tc.via)
+			if err != nil {
+				t.Fatal(err)
+			}
+			via, err := viaDialer(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			c, err := dialContext(ctx, via, "tcp", tc.to, !tc.untrusted)
+			if len(tc.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("want err with %q; got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if rc, ok := c.(*Conn); !ok || net.JoinHostPort(rc.HostName, rc.Port) != tc.to {
+				t.Fatalf("want a conn to backend %s; got %T %v", tc.to, c, c)
+			}
+
+			_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.WriteString(c, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			want := tc.banner + "ping"
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Fatalf("want %q; got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestViaDNSTarget(t *testing.T) {
+	backend := listen(t, echo)
+	socks := listen(t, socks5Server(""))
+	_, port, _ := net.SplitHostPort(backend)
+	c := &Conn{Typ: "tcp", HostName: egressName, Port: port}
+
+	for _, tc := range []struct {
+		via string
+		ok  bool
+	}{
+		// midway resolves names of dns targets, but for socks5h
+		{"socks5://u:p@" + socks, false},
+		{"socks5h://u:p@" + socks, true},
+	} {
+		u, err := parseVia(tc.via)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, done, err := Target{Kind: TargetDNS, Via: u}.dial(c)
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s: want ok %t; got err %v", tc.via, tc.ok, err)
+		}
+		if err == nil {
+			done()
+			dst.Close()
+		}
+	}
+}
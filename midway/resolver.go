@@ -0,0 +1,286 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/celzero/gateway/midway/env"
+	"github.com/miekg/dns"
+)
+
+// Resolver answers dns queries; transports (DoH, DoT) are but adapters
+// over a Resolver, and features are Middleware around one.
+type Resolver interface {
+	// Resolve answers q; or errs, for which transports answer SERVFAIL.
+	// q must not be modified.
+	Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+}
+
+// ResolverFunc is a func that is a Resolver
+type ResolverFunc func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return f(ctx, q)
+}
+
+// Middleware wraps next with a feature: it may answer queries itself,
+// or pass them on to next, or modify their answers.
+type Middleware func(next Resolver) Resolver
+
+var (
+	errNoQuestion = errors.New("dns: no question")
+	errNoUpstream = errors.New("dns: no answer from upstream")
+)
+
+// Chain wraps r in mws, of which the first sees queries first
+func Chain(r Resolver, mws ...Middleware) Resolver {
+	for i := len(mws) - 1; i >= 0; i-- {
+		r = mws[i](r)
+	}
+	return r
+}
+
+// Middlewares is the chain set up from env: log, limit, block, rewrite,
+// ech, and cache; in that order.
+func Middlewares() []Middleware {
+	mws := []Middleware{Log(), Limit(maxInflightQueries)}
+	if path := env.DNSBlocklist(); len(path) > 0 {
+		if names, err := readNames(path); err == nil {
+			log.Printf("dns: block %d names from %s", len(names), path)
+			mws = append(mws, Block(names))
+		} else {
+			log.Print("dns: no blocklist; ", err)
+		}
+	}
+	if path := env.DNSRewrites(); len(path) > 0 {
+		if rw, err := readRewrites(path); err == nil {
+			log.Printf("dns: rewrite %d names from %s", len(rw), path)
+			mws = append(mws, Rewrite(rw))
+		} else {
+			log.Print("dns: no rewrites; ", err)
+		}
+	}
+	return append(mws, ECH(), Cache(int(env.DNSCacheSize())))
+}
+
+// Log logs every query, its answer, how long it took, and whether it
+// was answered from the cache
+func Log() Middleware {
+	return func(next Resolver) Resolver {
+		return ResolverFunc(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+			start := time.Now()
+			tr := &trace{}
+			a, err := next.Resolve(context.WithValue(ctx, traceKey{}, tr), q)
+			took := time.Since(start).Round(time.Millisecond)
+			cached := ""
+			if len(tr.cache) > 0 {
+				cached = "; cache " + tr.cache
+			}
+			if err != nil {
+				log.Printf("doh: q0 %s => err %v in %s%s", querystr(q), err, took, cached)
+			} else {
+				log.Printf("doh: q0 %s => a0 %s | len(ans): %d %s in %s%s", querystr(q), ansstr(a), len(a.Answer),
+					dns.RcodeToString[a.Rcode], took, cached)
+			}
+			return a, err
+		})
+	}
+}
+
+// Limit answers REFUSED to queries over n in-flight; n <= 0 for no cap
+func Limit(n int64) Middleware {
+	return func(next Resolver) Resolver {
+		if n <= 0 {
+			return next
+		}
+		sem := make(chan struct{}, n)
+		return ResolverFunc(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				return next.Resolve(ctx, q)
+			default:
+				return responseWithCode(q, dns.RcodeRefused), nil
+			}
+		})
+	}
+}
+
+// Block answers NXDOMAIN to queries for names, and their subdomains
+func Block(names []string) Middleware {
+	set := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		set[dns.CanonicalName(n)] = struct{}{}
+	}
+	return func(next Resolver) Resolver {
+		return ResolverFunc(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+			if len(q.Question) > 0 {
+				if _, ok := lookupSuffix(set, q.Question[0].Name); ok {
+					return responseWithCode(q, dns.RcodeNameError), nil
+				}
+			}
+			return next.Resolve(ctx, q)
+		})
+	}
+}
+
+// Rewrite answers queries for a name in rw (or its subdomains) with
+// the ips it maps to, or with a CNAME to the name it maps to, along
+// with the answer for that name.
+func Rewrite(rw map[string]string) Middleware {
+	set := make(map[string]string, len(rw))
+	for k, v := range rw {
+		set[dns.CanonicalName(k)] = v
+	}
+	return func(next Resolver) Resolver {
+		return ResolverFunc(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+			if len(q.Question) <= 0 {
+				return next.Resolve(ctx, q)
+			}
+			qq := q.Question[0]
+			to, ok := lookupSuffix(set, qq.Name)
+			if !ok {
+				return next.Resolve(ctx, q)
+			}
+			if ips, ok := parseIPs(to); ok {
+				return answerIPs(q, ips), nil
+			}
+
+			cname := dns.Fqdn(to)
+			fwd := q.Copy()
+			fwd.Question[0].Name = cname
+			a, err := next.Resolve(ctx, fwd)
+			if err != nil {
+				return nil, err
+			}
+			a = a.Copy()
+			a.Id = q.Id
+			a.Question = q.Question
+			a.Answer = append([]dns.RR{&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: qq.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rewritettl},
+				Target: cname,
+			}}, a.Answer...)
+			return a, nil
+		})
+	}
+}
+
+// ECH adds midway's ECHConfigList to answers of HTTPS queries for
+// ECH_DOMAINS; see withECH
+func ECH() Middleware {
+	return func(next Resolver) Resolver {
+		return ResolverFunc(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+			a, err := next.Resolve(ctx, q)
+			if err != nil || !wantsECH(q) {
+				return a, err
+			}
+			return withECH(a.Copy()), nil
+		})
+	}
+}
+
+// rewritettl is the ttl of records synthesized by Rewrite
+const rewritettl = 60
+
+// answerIPs answers q with those of ips of its type
+func answerIPs(q *dns.Msg, ips []netip.Addr) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	qq := q.Question[0]
+	hdr := dns.RR_Header{Name: qq.Name, Rrtype: qq.Qtype, Class: dns.ClassINET, Ttl: rewritettl}
+	for _, ip := range ips {
+		switch {
+		case qq.Qtype == dns.TypeA && ip.Is4():
+			a.Answer = append(a.Answer, &dns.A{Hdr: hdr, A: net.IP(ip.AsSlice())})
+		case qq.Qtype == dns.TypeAAAA && ip.Is6():
+			a.Answer = append(a.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IP(ip.AsSlice())})
+		}
+	}
+	return a
+}
+
+// lookupSuffix finds name, or its closest parent, in set
+func lookupSuffix[T any](set map[string]T, name string) (T, bool) {
+	name = dns.CanonicalName(name)
+	for {
+		if v, ok := set[name]; ok {
+			return v, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			var zero T
+			return zero, false
+		}
+		name = name[i+1:]
+	}
+}
+
+// parseIPs parses comma-separated ips in s
+func parseIPs(s string) ([]netip.Addr, bool) {
+	var ips []netip.Addr
+	for _, v := range strings.Split(s, ",") {
+		ip, err := netip.ParseAddr(strings.TrimSpace(v))
+		if err != nil {
+			return nil, false
+		}
+		ips = append(ips, ip.Unmap())
+	}
+	return ips, len(ips) > 0
+}
+
+// readNames reads names, one per line, from the file at path
+func readNames(path string) ([]string, error) {
+	lines, err := env.ReadConf(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(lines))
+	for _, l := range lines {
+		names = append(names, l.Toks[0])
+	}
+	return names, nil
+}
+
+// readRewrites reads lines of the form "name ip[,ip...]" or "name name"
+// from the file at path
+func readRewrites(path string) (map[string]string, error) {
+	lines, err := env.ReadConf(path)
+	if err != nil {
+		return nil, err
+	}
+	rw := make(map[string]string, len(lines))
+	for _, l := range lines {
+		if len(l.Toks) != 2 {
+			return nil, fmt.Errorf("dns: %s:%d: want <name> <ips or name>", path, l.N)
+		}
+		rw[l.Toks[0]] = l.Toks[1]
+	}
+	return rw, nil
+}
+
+func querystr(m *dns.Msg) string {
+	if m == nil || m.Question == nil || len(m.Question) <= 0 {
+		return "no-query"
+	} else {
+		return m.Question[0].String()
+	}
+}
+
+func ansstr(m *dns.Msg) string {
+	if m == nil || m.Answer == nil || len(m.Answer) <= 0 {
+		return "no-ans"
+	} else {
+		return m.Answer[0].String()
+	}
+}
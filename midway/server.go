@@ -12,7 +12,6 @@ import (
 	"net"
 	"net/http"
 	"strings"
-	"sync"
 
 	"github.com/celzero/gateway/midway/env"
 	"github.com/celzero/gateway/midway/relay"
@@ -22,10 +21,16 @@ import (
 	"golang.org/x/net/http2/h2c"
 )
 
+var (
+	errNoListener   = errors.New("no listener")
+	errNoProxyUsers = errors.New("no proxy users")
+)
+
 var (
 	conntimeout        = env.ConnTimeoutSec()
 	maxInflightQueries = env.MaxInflightDNSQueries()
 	_, tlsDNSNames     = env.TlsCerts()
+	httpl7             = env.RelayHTTPL7()
 )
 
 func accept(c net.Conn) (net.Conn, bool) {
@@ -41,12 +46,22 @@ func accept(c net.Conn) (net.Conn, bool) {
 	return d, true
 }
 
-func StartPPWithDoH(tcp *proxyproto.Listener, doh DohResolver, wg *sync.WaitGroup) {
-	defer wg.Done()
+// acceptL7 is accept, but for http/1.x conns, which are relayed a
+// request at a time
+func acceptL7(c net.Conn) (net.Conn, bool) {
+	d := relay.NewProxyConn(c)
+	if d.Proto == relay.ProtoHTTP {
+		go d.ForwardHTTP()
+	} else {
+		go d.Forward()
+	}
+	return d, true
+}
 
+func StartPPWithDoH(tcp *proxyproto.Listener, doh DohResolver) error {
 	if tcp == nil {
 		log.Print("Exiting pp doh")
-		return
+		return errNoListener
 	}
 
 	if stls := relay.NewTlsListener(tcp, accept); stls != nil {
@@ -59,26 +74,22 @@ func StartPPWithDoH(tcp *proxyproto.Listener, doh DohResolver, wg *sync.WaitGrou
 			ReadTimeout:  conntimeout,
 			WriteTimeout: conntimeout,
 		}
+		atShutdown("doh+relay "+tcp.Addr().String(), dnsserver.Shutdown)
 
 		// http.Server takes ownership of stls
 		err := dnsserver.Serve(stls)
 		log.Print("exit doh+relay:", err)
+		return err
 	} else {
 		log.Print("mode: relay only ", tcp.Addr().String())
-
-		h := &sync.WaitGroup{}
-		h.Add(1)
-		StartPP(tcp, h)
-		h.Wait()
+		return StartPP(tcp)
 	}
 }
 
-func StartPPWithDoT(tcp *proxyproto.Listener, doh DohResolver, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+func StartPPWithDoT(tcp *proxyproto.Listener, doh DohResolver) error {
 	if tcp == nil {
 		log.Print("Exiting pp dot")
-		return
+		return errNoListener
 	}
 
 	if stls := relay.NewTlsListener(tcp, accept); stls != nil {
@@ -92,52 +103,116 @@ func StartPPWithDoT(tcp *proxyproto.Listener, doh DohResolver, wg *sync.WaitGrou
 			MaxTCPQueries: int(maxInflightQueries),
 			Handler:       doh.DnsHandler(),
 		}
+		atShutdown("dot+relay "+tcp.Addr().String(), dnsserver.ShutdownContext)
 
 		// ref: github.com/miekg/dns/blob/dedee46/server.go#L133
 		err := dnsserver.ActivateAndServe()
 		log.Print("exit dot+relay:", err)
+		return err
 	} else {
 		log.Print("mode: relay only ", tcp.Addr().String())
-
-		h := &sync.WaitGroup{}
-		h.Add(1)
-		StartPP(tcp, h)
-		h.Wait()
+		return StartPP(tcp)
 	}
 }
 
-func StartPP(tcp *proxyproto.Listener, wg *sync.WaitGroup) {
-	defer wg.Done()
+func StartPP(tcp *proxyproto.Listener) error {
+	return startPP("relay", tcp, accept)
+}
+
+// StartPPL7 relays each request on http/1.x conns to tcp to the backend
+// for its own Host (see relay.ForwardHTTP), and other conns as StartPP
+// does; or, if RELAY_HTTP_L7 is not set, all conns as StartPP does.
+func StartPPL7(tcp *proxyproto.Listener) error {
+	if !httpl7 {
+		return StartPP(tcp)
+	}
+	if tcp != nil {
+		log.Print("mode: relay l7 ", tcp.Addr().String())
+	}
+	return startPP("relay l7", tcp, acceptL7)
+}
 
+func startPP(name string, tcp *proxyproto.Listener, accept func(net.Conn) (net.Conn, bool)) error {
 	if tcp == nil {
 		log.Print("Exiting pp tcp")
-		return
+		return errNoListener
 	}
 
 	defer tcp.Close()
+	atShutdown(name+" "+tcp.Addr().String(), closer(tcp))
 
 	for {
 		if conn, err := tcp.Accept(); err == nil {
-			if _, ok := accept(conn); !ok {
+			if conn, ok := relay.Admit(conn); !ok {
+				continue // shed
+			} else if _, ok := accept(conn); !ok {
 				log.Print("cannot accept conn")
 			}
 		} else {
 			log.Print("handle pp tcp err")
 			if errors.Is(err, net.ErrClosed) {
 				log.Print(err)
-				return
+				return err
 			}
 		}
 	}
 }
 
-// ref: github.com/thrawn01/h2c-golang-example
-func StartPPWithDoHCleartext(tcp *proxyproto.Listener, doh DohResolver, wg *sync.WaitGroup) {
-	defer wg.Done()
+// StartHttpProxy serves an explicit http proxy (CONNECT and absolute-form
+// requests) on tcp, relaying conns just as StartPP would.
+func StartHttpProxy(tcp *proxyproto.Listener) error {
+	return startExplicitProxy("http proxy", tcp, relay.NewHttpProxyConn)
+}
+
+// StartSocks serves a socks5 proxy on tcp, relaying conns just as
+// StartPP would.
+func StartSocks(tcp *proxyproto.Listener) error {
+	return startExplicitProxy("socks5", tcp, relay.NewSocksConn)
+}
 
+func startExplicitProxy(name string, tcp *proxyproto.Listener, handshake func(net.Conn) *relay.Conn) error {
+	if tcp == nil {
+		log.Print("Exiting pp ", name)
+		return errNoListener
+	}
+	if !relay.HasProxyUsers() {
+		// else, an open relay
+		tcp.Close()
+		log.Print("Exiting pp ", name, "; no SOCKS_USERS")
+		return errNoProxyUsers
+	}
+
+	defer tcp.Close()
+	atShutdown(name+" "+tcp.Addr().String(), closer(tcp))
+
+	log.Print("mode: ", name, " ", tcp.Addr().String())
+
+	for {
+		if conn, err := tcp.Accept(); err == nil {
+			conn, ok := relay.Admit(conn)
+			if !ok {
+				continue // shed
+			}
+			go func() {
+				if d := handshake(conn); d != nil {
+					d.Forward()
+				}
+			}()
+		} else {
+			log.Print("handle pp ", name, " err")
+			if errors.Is(err, net.ErrClosed) {
+				log.Print(err)
+				return err
+			}
+		}
+	}
+}
+
+// ref: github.com/thrawn01/h2c-golang-example
+func StartPPWithDoHCleartext(tcp *proxyproto.Listener, doh DohResolver) error {
 	if tcp == nil {
 		log.Print("Exiting pp doh")
-		return
+		return errNoListener
 	}
 
 	log.Print("mode: DoH cleartext ", tcp.Addr().String())
@@ -160,17 +235,17 @@ func StartPPWithDoHCleartext(tcp *proxyproto.Listener, doh DohResolver, wg *sync
 		ReadTimeout:  conntimeout,
 		WriteTimeout: conntimeout,
 	}
+	atShutdown("doh cleartext "+tcp.Addr().String(), dnsserver.Shutdown)
 
 	err := dnsserver.Serve(tcp)
 	log.Print("exit doh cleartext:", err)
+	return err
 }
 
-func StartPPWithDoTCleartext(tcp *proxyproto.Listener, doh DohResolver, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+func StartPPWithDoTCleartext(tcp *proxyproto.Listener, doh DohResolver) error {
 	if tcp == nil {
 		log.Print("Exiting pp dot")
-		return
+		return errNoListener
 	}
 
 	log.Print("mode: DoT cleartext ", tcp.Addr().String())
@@ -182,8 +257,10 @@ func StartPPWithDoTCleartext(tcp *proxyproto.Listener, doh DohResolver, wg *sync
 		MaxTCPQueries: int(maxInflightQueries),
 		Handler:       doh.DnsHandler(),
 	}
+	atShutdown("dot cleartext "+tcp.Addr().String(), dnsserver.ShutdownContext)
 
 	// ref: github.com/miekg/dns/blob/dedee46/server.go#L133
 	err := dnsserver.ActivateAndServe()
 	log.Print("exit dot cleartext:", err)
+	return err
 }
@@ -0,0 +1,87 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/celzero/gateway/midway/relay"
+)
+
+type stopper struct {
+	name string
+	stop func(context.Context) error
+}
+
+var (
+	stopmu   sync.Mutex
+	stoppers []stopper
+)
+
+// atShutdown registers fn to stop the listener or server called name;
+// replacing fn registered prior, if any, by a listener since restarted
+func atShutdown(name string, fn func(context.Context) error) {
+	stopmu.Lock()
+	defer stopmu.Unlock()
+	for i := range stoppers {
+		if stoppers[i].name == name {
+			stoppers[i].stop = fn
+			return
+		}
+	}
+	stoppers = append(stoppers, stopper{name, fn})
+}
+
+// closer stops c by closing it, as listeners sans servers have no
+// in-flight work of their own to wait for
+func closer(c interface{ Close() error }) func(context.Context) error {
+	return func(context.Context) error {
+		return c.Close()
+	}
+}
+
+// Shutdown stops all listeners and servers from accepting new conns,
+// lets in-flight dns queries and relayed conns finish until ctx is done
+// (cutting those that don't), and logs a summary.
+func Shutdown(ctx context.Context) {
+	start := time.Now()
+
+	// listeners that exit from here on are meant to
+	sv.stop()
+
+	stopmu.Lock()
+	all := stoppers
+	stoppers = nil
+	stopmu.Unlock()
+
+	// stop all at once, so that a slow server doesn't hold up others
+	var failed int32
+	wg := &sync.WaitGroup{}
+	wg.Add(len(all))
+	for _, s := range all {
+		go func(s stopper) {
+			defer wg.Done()
+			err := s.stop(ctx)
+			if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("shutdown: %s: %v", s.name, err)
+				atomic.AddInt32(&failed, 1)
+			}
+		}(s)
+	}
+
+	total, cut := relay.Drain(ctx)
+	wg.Wait()
+
+	log.Printf("shutdown: stopped %d listeners (%d errs); relay conns: %d in-flight, %d drained, %d cut; took %s",
+		len(all), failed, total, total-cut, cut, time.Since(start).Round(time.Millisecond))
+}
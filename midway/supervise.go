@@ -0,0 +1,187 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff  = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+	maxRestarts = 6               // consecutive, before giving up
+	stableAfter = 1 * time.Minute // runs this long reset the restarts
+)
+
+// listener states
+const (
+	stateUp      = "up"
+	stateBackoff = "backoff"
+	stateFailed  = "failed"
+	stateStopped = "stopped"
+)
+
+var sv = &supervisor{fatal: make(chan error, 1)}
+
+// supervisor runs listeners, restarting those that exit while they
+// shouldn't have, with exponential backoff.
+type supervisor struct {
+	mu       sync.Mutex
+	procs    []*proc
+	stopping bool
+	fatal    chan error // a critical listener gave up
+}
+
+// proc is a supervised listener
+type proc struct {
+	Name     string    `json:"name"`
+	Critical bool      `json:"critical"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts"`
+	LastErr  string    `json:"lasterr,omitempty"`
+
+	run func() error
+}
+
+// Supervise runs run (which listens and then serves until it can't) in
+// a goroutine, and runs it again with backoff whenever it returns, until
+// shutdown. If run fails too many times in a row, it is given up on;
+// and if it is critical, the process ought to exit: see Fatal.
+func Supervise(name string, critical bool, run func() error) {
+	p := &proc{Name: name, Critical: critical, run: run}
+	sv.mu.Lock()
+	sv.procs = append(sv.procs, p)
+	sv.mu.Unlock()
+
+	go sv.loop(p)
+}
+
+// Fatal signals once a critical listener has been given up on
+func Fatal() <-chan error {
+	return sv.fatal
+}
+
+func (s *supervisor) loop(p *proc) {
+	backoff := minBackoff
+	fails := 0
+	for {
+		if !s.set(p, stateUp, nil) {
+			return
+		}
+		start := time.Now()
+		err := p.run()
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		if time.Since(start) >= stableAfter {
+			backoff, fails = minBackoff, 0
+		}
+		fails++
+
+		if fails > maxRestarts {
+			if !s.set(p, stateFailed, err) {
+				return
+			}
+			log.Printf("supervisor: %s failed %d times; giving up; err: %v", p.Name, fails, err)
+			if p.Critical {
+				select {
+				case s.fatal <- fmt.Errorf("%s: %w", p.Name, err):
+				default:
+				}
+			}
+			return
+		}
+
+		if !s.set(p, stateBackoff, err) {
+			return
+		}
+		log.Printf("supervisor: %s exited (%v); restart #%d in %s", p.Name, err, fails, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// set moves p to state, unless stopping, in which case p is stopped
+// and false is returned.
+func (s *supervisor) set(p *proc, state string, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping {
+		state = stateStopped
+	}
+	if state == stateUp && p.State != "" {
+		p.Restarts++
+	}
+	p.State = state
+	p.Since = time.Now()
+	if err != nil {
+		p.LastErr = err.Error()
+	}
+	return state != stateStopped
+}
+
+// stop lets listeners that exit, stay down
+func (s *supervisor) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopping = true
+}
+
+func (s *supervisor) status() []proc {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make([]proc, 0, len(s.procs))
+	for _, p := range s.procs {
+		all = append(all, *p)
+	}
+	return all
+}
+
+// StartStatus serves the state of each supervised listener as json at
+// /h/s on tcp; which, as it tells of internal addrs and errs, ought to
+// be a local, or otherwise private, listener.
+func StartStatus(tcp net.Listener) error {
+	if tcp == nil {
+		log.Print("Exiting status")
+		return errNoListener
+	}
+
+	log.Print("mode: status ", tcp.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/h/s", statusHandler)
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  conntimeout,
+		WriteTimeout: conntimeout,
+	}
+	atShutdown("status "+tcp.Addr().String(), srv.Shutdown)
+
+	err := srv.Serve(tcp)
+	log.Print("exit status: ", err)
+	return err
+}
+
+// statusHandler responds with the state of each supervised listener
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(sv.status()); err != nil {
+		log.Print("supervisor: status err ", err)
+	}
+}
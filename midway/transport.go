@@ -0,0 +1,366 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// stream conns idle for streamIdle are closed
+	streamIdle = 30 * time.Second
+	// most queries in-flight on a stream conn
+	maxPipelined = 1024
+	// advertised in queries sent over udp sans edns
+	udpSize = 1232
+)
+
+var (
+	errStreamClosed = errors.New("dns: upstream conn closed")
+	errTooMany      = errors.New("dns: too many queries in-flight")
+	errMismatch     = errors.New("dns: answer not for the query")
+)
+
+// streamUpstream resolves queries over tcp, or tls (DoT), pipelined on
+// one conn (rfc7766 6.2.1.1), which is redialed once it closes
+type streamUpstream struct {
+	addr string
+	tls  *tls.Config // nil for plain tcp
+
+	mu sync.Mutex
+	c  *stream // may be nil or closed
+}
+
+// stream is a conn with queries in-flight on it, by id
+type stream struct {
+	conn *dns.Conn
+	wmu  sync.Mutex // serializes writes
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	done    chan struct{} // closed once conn is
+	err     error
+}
+
+func newStreamUpstream(addr string, tlsconf *tls.Config) *streamUpstream {
+	return &streamUpstream{addr: addr, tls: tlsconf}
+}
+
+func (s *streamUpstream) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	// queries the upstream drops are given up on
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	a, err := s.resolve(ctx, q)
+	if err != nil && ctx.Err() == nil {
+		// the upstream may have closed a conn that was idle; retry once,
+		// on a new conn
+		return s.resolve(ctx, q)
+	}
+	return a, err
+}
+
+func (s *streamUpstream) resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	c, err := s.stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	m := q.Copy()
+	m.Id = id
+	c.wmu.Lock()
+	d, _ := ctx.Deadline()
+	_ = c.conn.SetWriteDeadline(d)
+	err = c.conn.WriteMsg(m)
+	c.wmu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	select {
+	case a := <-ch:
+		a.Id = q.Id
+		return a, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stream returns the open conn, or dials a new one
+func (s *streamUpstream) stream(ctx context.Context) (*stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.c != nil && !s.c.closed() {
+		return s.c, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conntimeout)
+	defer cancel()
+	var nc net.Conn
+	var err error
+	if s.tls != nil {
+		d := &tls.Dialer{Config: s.tls}
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		d := &net.Dialer{}
+		nc, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.c = &stream{
+		conn:    &dns.Conn{Conn: nc},
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	go s.c.read()
+	return s.c, nil
+}
+
+// register reserves an unused, random id for a query, and the chan its
+// answer is sent to
+func (c *stream) register() (uint16, chan *dns.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	} else if len(c.pending) >= maxPipelined {
+		return 0, nil, errTooMany
+	}
+	for {
+		id := dns.Id() // crypto/rand
+		if _, ok := c.pending[id]; !ok {
+			ch := make(chan *dns.Msg, 1)
+			c.pending[id] = ch
+			return id, ch, nil
+		}
+	}
+}
+
+func (c *stream) unregister(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// read hands answers to the queries they are for, until conn fails,
+// or has been idle for long
+func (c *stream) read() {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(streamIdle))
+		a, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[a.Id]
+		delete(c.pending, a.Id)
+		c.mu.Unlock()
+		if ok {
+			ch <- a
+		} // else: an answer to a query given up on
+	}
+}
+
+func (c *stream) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = errStreamClosed
+	if err != nil {
+		c.err = err
+	}
+	c.conn.Close()
+	close(c.done)
+}
+
+func (c *stream) closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// udpUpstream resolves queries over udp; and those with truncated
+// answers, over tcp
+type udpUpstream struct {
+	addr string
+	udp  *dns.Client
+	tcp  *streamUpstream
+}
+
+func newUDPUpstream(addr string) *udpUpstream {
+	return &udpUpstream{
+		addr: addr,
+		udp:  &dns.Client{Net: "udp", UDPSize: udpSize, Timeout: conntimeout},
+		tcp:  newStreamUpstream(addr, nil),
+	}
+}
+
+func (u *udpUpstream) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	// answers are cached, and served to all; so, an off-path spoofer
+	// must not know the id (as a client that picked it would)
+	m := q.Copy()
+	m.Id = dns.Id()
+	edns := m.IsEdns0() != nil
+	if !edns {
+		m.SetEdns0(udpSize, false)
+	}
+	a, _, err := u.udp.ExchangeContext(ctx, m, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if !answers(m, a) {
+		return nil, errMismatch
+	}
+	if a.Truncated {
+		return u.tcp.Resolve(ctx, q)
+	}
+	if !edns {
+		// the client didn't ask for edns, and so isn't sent it back
+		a.Extra = withoutOPT(a.Extra)
+	}
+	a.Id = q.Id
+	return a, nil
+}
+
+// answers tells whether a is an answer to q: same id, and same question
+func answers(q, a *dns.Msg) bool {
+	if !a.Response || a.Id != q.Id || len(a.Question) != len(q.Question) {
+		return false
+	}
+	for i := range q.Question {
+		qq, aq := q.Question[i], a.Question[i]
+		if qq.Qtype != aq.Qtype || qq.Qclass != aq.Qclass || !strings.EqualFold(qq.Name, aq.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// withTimeout bounds ctx by conntimeout, unless it has a deadline
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, conntimeout)
+}
+
+func withoutOPT(rrs []dns.RR) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// doqUpstream resolves queries over quic (DoQ, rfc9250), a query to a
+// stream, on one conn, which is redialed once it closes
+type doqUpstream struct {
+	addr string
+	tls  *tls.Config
+
+	mu sync.Mutex
+	c  quic.Connection // may be nil or closed
+}
+
+func newDoQUpstream(addr string, tlsconf *tls.Config) *doqUpstream {
+	tlsconf.NextProtos = []string{doqALPN}
+	return &doqUpstream{addr: addr, tls: tlsconf}
+}
+
+func (d *doqUpstream) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	a, err := d.resolve(ctx, q)
+	if err != nil && ctx.Err() == nil {
+		// as with streamUpstream, the conn may have gone idle
+		return d.resolve(ctx, q)
+	}
+	return a, err
+}
+
+func (d *doqUpstream) resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	c, err := d.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		d.drop(c, err)
+		return nil, err
+	}
+	defer st.CancelRead(0)
+	dl, _ := ctx.Deadline()
+	_ = st.SetDeadline(dl)
+
+	// rfc9250 4.2.1
+	m := q.Copy()
+	m.Id = 0
+	if err := writePrefixed(st, m); err != nil {
+		return nil, err
+	}
+	// the client signals the end of its query with a FIN
+	st.Close()
+	a, err := readPrefixed(st)
+	if err != nil {
+		return nil, err
+	}
+	a.Id = q.Id
+	return a, nil
+}
+
+// conn returns the open conn, or dials a new one
+func (d *doqUpstream) conn(ctx context.Context) (quic.Connection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.c != nil && d.c.Context().Err() == nil {
+		return d.c, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conntimeout)
+	defer cancel()
+	c, err := quic.DialAddr(ctx, d.addr, d.tls, &quic.Config{
+		MaxIdleTimeout: streamIdle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.c = c
+	return c, nil
+}
+
+// drop closes c, if it is still the conn queries go out on
+func (d *doqUpstream) drop(c quic.Connection, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.c == c {
+		_ = c.CloseWithError(0, err.Error())
+		d.c = nil
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serveDNS serves h on a local udp or tcp addr until the test ends
+func serveDNS(t *testing.T, nw, addr string, h dns.HandlerFunc, opts ...func(*dns.Server)) string {
+	t.Helper()
+	srv := &dns.Server{Net: nw, Handler: h}
+	for _, o := range opts {
+		o(srv)
+	}
+	switch nw {
+	case "udp":
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.PacketConn = pc
+		addr = pc.LocalAddr().String()
+	default:
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Listener = ln
+		addr = ln.Addr().String()
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return addr
+}
+
+// answerA answers queries with an A record for 127.0.0.1
+func answerA(w dns.ResponseWriter, q *dns.Msg) {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Answer = append(a.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(127, 0, 0, 1),
+	})
+	_ = w.WriteMsg(a)
+}
+
+func query(name string) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return q
+}
+
+func TestUDPUpstreamFallsBackToTCP(t *testing.T) {
+	var viatcp int32
+	tcpaddr := serveDNS(t, "tcp", "127.0.0.1:0", func(w dns.ResponseWriter, q *dns.Msg) {
+		atomic.AddInt32(&viatcp, 1)
+		answerA(w, q)
+	})
+	// the udp server, on the same port, answers truncated
+	serveDNS(t, "udp", tcpaddr, func(w dns.ResponseWriter, q *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Truncated = true
+		_ = w.WriteMsg(a)
+	})
+
+	q := query("tc.example")
+	a, err := newUDPUpstream(tcpaddr).Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Truncated || len(a.Answer) != 1 || a.Id != q.Id {
+		t.Fatalf("want an untruncated answer with id %d; got %v", q.Id, a)
+	}
+	if atomic.LoadInt32(&viatcp) != 1 {
+		t.Fatalf("want 1 query over tcp; got %d", viatcp)
+	}
+}
+
+func TestUDPUpstreamRandomizesID(t *testing.T) {
+	seen := make(chan uint16, 1)
+	addr := serveDNS(t, "udp", "127.0.0.1:0", func(w dns.ResponseWriter, q *dns.Msg) {
+		seen <- q.Id
+		answerA(w, q)
+	})
+
+	q := query("id.example")
+	q.Id = 4242
+	a, err := newUDPUpstream(addr).Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := <-seen; id == q.Id {
+		t.Fatalf("upstream was sent the client's id %d", id)
+	}
+	if a.Id != q.Id {
+		t.Fatalf("want id %d restored; got %d", q.Id, a.Id)
+	}
+	if a.IsEdns0() != nil {
+		t.Fatal("answer to a query sans edns has an OPT")
+	}
+}
+
+func TestUDPUpstreamRejectsMismatch(t *testing.T) {
+	addr := serveDNS(t, "udp", "127.0.0.1:0", func(w dns.ResponseWriter, q *dns.Msg) {
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Question[0].Name = "spoofed.example."
+		_ = w.WriteMsg(a)
+	})
+
+	if _, err := newUDPUpstream(addr).Resolve(context.Background(), query("q.example")); err == nil {
+		t.Fatal("want an err for an answer to another question")
+	}
+}
+
+func TestStreamUpstreamPipelines(t *testing.T) {
+	// a server that answers each query on a conn as soon as it is done
+	// with it, and so, out of order
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var conns int32
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				c := &dns.Conn{Conn: nc}
+				defer c.Close()
+				var wmu sync.Mutex
+				for {
+					q, err := c.ReadMsg()
+					if err != nil {
+						return
+					}
+					go func() {
+						time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+						a := new(dns.Msg)
+						a.SetReply(q)
+						a.Answer = append(a.Answer, &dns.A{
+							Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+							A:   net.IPv4(127, 0, 0, 1),
+						})
+						wmu.Lock()
+						_ = c.WriteMsg(a)
+						wmu.Unlock()
+					}()
+				}
+			}()
+		}
+	}()
+	addr := ln.Addr().String()
+
+	s := newStreamUpstream(addr, nil)
+	// dial before the burst, so that all of it goes out on one conn
+	if _, err := s.Resolve(context.Background(), query("warm.example")); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 200
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			q := query(fmt.Sprintf("q%d.example", i))
+			a, err := s.Resolve(context.Background(), q)
+			if err != nil {
+				errs <- err
+			} else if a.Id != q.Id || len(a.Answer) != 1 || a.Answer[0].Header().Name != q.Question[0].Name {
+				errs <- fmt.Errorf("q%d: got answer %v", i, a)
+			} else {
+				errs <- nil
+			}
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("want queries pipelined on 1 conn; got %d", n)
+	}
+}
+
+func TestStreamUpstreamRedials(t *testing.T) {
+	var accepted int32
+	addr := serveDNS(t, "tcp", "127.0.0.1:0", func(w dns.ResponseWriter, q *dns.Msg) {
+		answerA(w, q)
+	}, func(s *dns.Server) {
+		s.IdleTimeout = func() time.Duration { return 50 * time.Millisecond }
+		s.MsgAcceptFunc = func(dh dns.Header) dns.MsgAcceptAction {
+			atomic.AddInt32(&accepted, 1)
+			return dns.DefaultMsgAcceptFunc(dh)
+		}
+	})
+
+	s := newStreamUpstream(addr, nil)
+	if _, err := s.Resolve(context.Background(), query("one.example")); err != nil {
+		t.Fatal(err)
+	}
+	first := s.c
+
+	// the server closes the conn, once it is idle
+	time.Sleep(200 * time.Millisecond)
+	if _, err := s.Resolve(context.Background(), query("two.example")); err != nil {
+		t.Fatal(err)
+	}
+	if s.c == first {
+		t.Fatal("want a new conn once the idle one is closed")
+	}
+	if atomic.LoadInt32(&accepted) != 2 {
+		t.Fatalf("want 2 queries answered; got %d", accepted)
+	}
+}
+
+func TestStreamUpstreamTimesOut(t *testing.T) {
+	// the server reads queries, but never answers them
+	addr := serveDNS(t, "tcp", "127.0.0.1:0", func(w dns.ResponseWriter, q *dns.Msg) {})
+
+	prev := conntimeout
+	conntimeout = 100 * time.Millisecond
+	defer func() { conntimeout = prev }()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := newStreamUpstream(addr, nil).Resolve(context.Background(), query("drop.example"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("want a timeout for a dropped query; got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped query never timed out")
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// strategies to pick upstreams with; see env.UpstreamStrategy
+const (
+	StrategyFailover = "failover"
+	StrategyRR       = "rr"
+	StrategyFastest  = "fastest"
+	StrategyHedge    = "hedge"
+)
+
+const (
+	// upstreams that fail ejectAfter times in a row are ejected for
+	// ejectFor, doubled for every ejection in a row, up to maxEject
+	ejectAfter = 3
+	ejectFor   = 10 * time.Second
+	maxEject   = 5 * time.Minute
+	// weight of the latest latency in an upstream's ewma
+	ewmaAlpha = 0.3
+	// one in exploreEvery queries, the fastest strategy tries upstreams
+	// in turn, so that latencies of slower ones stay current
+	exploreEvery = 32
+)
+
+var (
+	errNoUpstreams = errors.New("dns: no upstreams")
+	errStrategy    = errors.New("dns: unknown upstream strategy")
+	errRcode       = errors.New("dns: upstream failed")
+)
+
+// upstream is a resolver, and how it has fared
+type upstream struct {
+	name string
+	r    Resolver
+
+	mu       sync.Mutex
+	ewma     time.Duration // 0 until measured
+	fails    int           // in a row
+	ejects   int           // in a row
+	downtill time.Time
+}
+
+// upstreams picks among upstream resolvers as per its strategy, and if
+// one fails, asks the next; see NewUpstreams
+type upstreams struct {
+	all      []*upstream
+	strategy string
+	hedge    time.Duration
+	n        uint32 // queries so far
+}
+
+// NewUpstream is a resolver for url, by its scheme:
+//
+//	https://dns.google/dns-query        DoH
+//	tls://dns.google[:853]              DoT
+//	tls://8.8.8.8#dns.google            DoT, verified against the name after #
+//	udp://10.0.0.53[:53]                dns over udp, and if need be, tcp
+//	tcp://10.0.0.53[:53]                dns over tcp
+//	quic://dns.adguard-dns.com[:853]    DoQ; takes a #name to verify against, as tls does
+func NewUpstream(u string) (Resolver, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if len(pu.Host) <= 0 {
+		return nil, fmt.Errorf("%w: no host in %s", errNoUpstreams, u)
+	}
+	addr := func(port string) string {
+		if len(pu.Port()) > 0 {
+			return pu.Host
+		}
+		return net.JoinHostPort(pu.Hostname(), port)
+	}
+	switch pu.Scheme {
+	case "https":
+		return newDohUpstream(u), nil
+	case "tls", "quic":
+		sni := pu.Hostname()
+		if len(pu.Fragment) > 0 {
+			sni = pu.Fragment
+		}
+		tlsconf := &tls.Config{
+			ServerName: sni,
+			MinVersion: tls.VersionTLS12,
+		}
+		if pu.Scheme == "quic" {
+			return newDoQUpstream(addr("853"), tlsconf), nil
+		}
+		return newStreamUpstream(addr("853"), tlsconf), nil
+	case "tcp":
+		return newStreamUpstream(addr("53"), nil), nil
+	case "udp":
+		return newUDPUpstream(addr("53")), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported scheme in %s", errNoUpstreams, u)
+}
+
+// NewUpstreams resolves queries with resolvers at urls (see NewUpstream)
+// picked by strategy, one of StrategyFailover, StrategyRR, StrategyFastest,
+// or StrategyHedge (which asks the next fastest, too, if the fastest is
+// yet to answer after hedge). Failed queries are retried on the next
+// upstream; and upstreams that fail in a row are ejected for a while.
+func NewUpstreams(urls []string, strategy string, hedge time.Duration) (Resolver, error) {
+	switch strategy {
+	case StrategyFailover, StrategyRR, StrategyFastest, StrategyHedge:
+	default:
+		return nil, fmt.Errorf("%w: %q", errStrategy, strategy)
+	}
+	u := &upstreams{strategy: strategy, hedge: hedge}
+	for _, x := range urls {
+		r, err := NewUpstream(x)
+		if err != nil {
+			return nil, err
+		}
+		u.all = append(u.all, &upstream{name: x, r: r})
+	}
+	if len(u.all) <= 0 {
+		return nil, errNoUpstreams
+	}
+	log.Printf("dns: %d upstreams; strategy %s", len(u.all), strategy)
+	return u, nil
+}
+
+func (u *upstreams) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	cands := u.pick()
+	// each attempt gets its share of the time, so that a blackholed
+	// upstream doesn't use it all up before the next one is asked
+	timeout := conntimeout / time.Duration(len(cands))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops queries still in-flight
+
+	type res struct {
+		a   *dns.Msg
+		err error
+	}
+	ch := make(chan res, len(cands))
+	next, inflight := 0, 0
+	ask := func() {
+		up := cands[next]
+		next++
+		inflight++
+		go func() {
+			a, err := up.resolve(ctx, q.Copy(), timeout)
+			ch <- res{a, err}
+		}()
+	}
+
+	ask()
+	var hedged <-chan time.Time
+	if u.strategy == StrategyHedge && next < len(cands) {
+		t := time.NewTimer(u.hedge)
+		defer t.Stop()
+		hedged = t.C
+	}
+
+	var err error
+	var last *dns.Msg // a SERVFAIL or REFUSED, if any
+	for inflight > 0 {
+		select {
+		case r := <-ch:
+			inflight--
+			if r.err == nil {
+				return r.a, nil
+			}
+			err = r.err
+			if r.a != nil {
+				last = r.a
+			}
+			if next < len(cands) {
+				ask() // fail over
+			}
+		case <-hedged:
+			hedged = nil
+			if next < len(cands) {
+				ask()
+			}
+		}
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+// pick orders upstreams to ask as per the strategy; healthy ones first
+func (u *upstreams) pick() []*upstream {
+	n := atomic.AddUint32(&u.n, 1)
+	now := time.Now()
+
+	up, down := make([]*upstream, 0, len(u.all)), []*upstream{}
+	for _, x := range u.all {
+		if x.healthy(now) {
+			up = append(up, x)
+		} else {
+			down = append(down, x)
+		}
+	}
+
+	strategy := u.strategy
+	if (strategy == StrategyFastest || strategy == StrategyHedge) && n%exploreEvery == 0 {
+		strategy = StrategyRR
+	}
+	switch strategy {
+	case StrategyRR:
+		if len(up) > 0 {
+			i := int(n % uint32(len(up)))
+			up = append(up[i:], up[:i]...)
+		}
+	case StrategyFastest, StrategyHedge:
+		// unmeasured upstreams, at 0, go first
+		sort.SliceStable(up, func(i, j int) bool {
+			return up[i].latency() < up[j].latency()
+		})
+	}
+	// if all are down, ask them anyway
+	return append(up, down...)
+}
+
+// resolve asks q of up within timeout, and tracks how it fares. SERVFAIL
+// and REFUSED are failures, returned along with errRcode.
+func (up *upstream) resolve(ctx context.Context, q *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	actx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	a, err := up.r.Resolve(actx, q)
+	took := time.Since(start)
+	if err == nil && a != nil && (a.Rcode == dns.RcodeServerFailure || a.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("%w: %s", errRcode, dns.RcodeToString[a.Rcode])
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if ctx.Err() != nil && err != nil {
+		// cancelled, as another upstream answered (or the client left);
+		// up would've taken at least as long
+		if took > up.ewma {
+			up.observe(took)
+		}
+		return nil, err
+	}
+	if err == nil {
+		up.observe(took)
+		if up.ejects > 0 {
+			log.Printf("dns: upstream %s reinstated", up.name)
+		}
+		up.fails, up.ejects = 0, 0
+		return a, nil
+	}
+
+	up.fails++
+	if up.fails >= ejectAfter && time.Now().After(up.downtill) {
+		d := ejectFor << up.ejects
+		if d > maxEject || d <= 0 {
+			d = maxEject
+		}
+		up.ejects++
+		up.downtill = time.Now().Add(d)
+		log.Printf("dns: upstream %s ejected for %s after %d fails; err %v", up.name, d, up.fails, err)
+	}
+	if errors.Is(err, errRcode) {
+		return a, fmt.Errorf("%s: %w", up.name, err)
+	}
+	return nil, fmt.Errorf("%s: %w", up.name, err)
+}
+
+// observe folds took into the latency ewma; up.mu must be held
+func (up *upstream) observe(took time.Duration) {
+	if up.ewma <= 0 {
+		up.ewma = took
+	} else {
+		up.ewma = time.Duration(ewmaAlpha*float64(took) + (1-ewmaAlpha)*float64(up.ewma))
+	}
+}
+
+func (up *upstream) healthy(now time.Time) bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return now.After(up.downtill)
+}
+
+func (up *upstream) latency() time.Duration {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.ewma
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2022 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package midway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// answerRcode answers queries with rcode
+func answerRcode(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, q *dns.Msg) {
+		_ = w.WriteMsg(responseWithCode(q, rcode))
+	}
+}
+
+func newTestUpstreams(t *testing.T, addrs ...string) *upstreams {
+	t.Helper()
+	var urls []string
+	for _, a := range addrs {
+		urls = append(urls, "udp://"+a)
+	}
+	r, err := NewUpstreams(urls, StrategyFailover, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.(*upstreams)
+}
+
+func TestUpstreamsFailOverOnRcode(t *testing.T) {
+	for _, rcode := range []int{dns.RcodeServerFailure, dns.RcodeRefused} {
+		t.Run(dns.RcodeToString[rcode], func(t *testing.T) {
+			bad := serveDNS(t, "udp", "127.0.0.1:0", answerRcode(rcode))
+			good := serveDNS(t, "udp", "127.0.0.1:0", answerA)
+			u := newTestUpstreams(t, bad, good)
+
+			a, err := u.Resolve(context.Background(), query("rcode.example"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Rcode != dns.RcodeSuccess || len(a.Answer) != 1 {
+				t.Fatalf("want the answer of the next upstream; got %v", a)
+			}
+			if u.all[0].fails != 1 || u.all[1].fails != 0 {
+				t.Fatalf("want 1 fail of the first upstream; got %d, %d", u.all[0].fails, u.all[1].fails)
+			}
+		})
+	}
+}
+
+func TestUpstreamsAllFail(t *testing.T) {
+	a1 := serveDNS(t, "udp", "127.0.0.1:0", answerRcode(dns.RcodeRefused))
+	a2 := serveDNS(t, "udp", "127.0.0.1:0", answerRcode(dns.RcodeServerFailure))
+	u := newTestUpstreams(t, a1, a2)
+
+	for i := 0; i < ejectAfter; i++ {
+		a, err := u.Resolve(context.Background(), query("fail.example"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the last failure is relayed as-is
+		if a.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("want SERVFAIL; got %s", dns.RcodeToString[a.Rcode])
+		}
+	}
+	now := time.Now()
+	if u.all[0].healthy(now) || u.all[1].healthy(now) {
+		t.Fatal("want upstreams that fail in a row ejected")
+	}
+}
+
+func TestUpstreamsBlackholeGetsItsShare(t *testing.T) {
+	prev := conntimeout
+	conntimeout = 600 * time.Millisecond
+	defer func() { conntimeout = prev }()
+
+	// reads queries, but never answers them
+	blackhole := serveDNS(t, "udp", "127.0.0.1:0", func(w dns.ResponseWriter, q *dns.Msg) {})
+	good := serveDNS(t, "udp", "127.0.0.1:0", answerA)
+	u := newTestUpstreams(t, blackhole, good)
+
+	start := time.Now()
+	a, err := u.Resolve(context.Background(), query("blackhole.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Answer) != 1 {
+		t.Fatalf("want the answer of the next upstream; got %v", a)
+	}
+	if took := time.Since(start); took >= conntimeout {
+		t.Fatalf("the blackholed upstream took %s of %s", took, conntimeout)
+	}
+}